@@ -0,0 +1,214 @@
+// Package capture writes the datagrams a proxy handles to a pcap file that
+// standard tools read without root. The Ethernet, IP and UDP headers are
+// synthesized from the socket addresses. What happened to a packet (dropped,
+// delayed, ...) goes to a CSV sidecar keyed by frame number
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagicNanos = 0xa1b23c4d // classic pcap with nanosecond timestamps
+	linkTypeEther  = 1
+	snapLen        = 262144
+
+	etherHeaderSize = 14
+	ipv4HeaderSize  = 20
+	ipv6HeaderSize  = 40
+	udpHeaderSize   = 8
+)
+
+// SidecarSuffix is appended to the capture path for the annotation file
+const SidecarSuffix = ".events.csv"
+
+// Writer appends frames to a pcap file and annotations to its sidecar, it
+// is safe for concurrent use
+type Writer struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	sidecar *os.File
+	events  *csv.Writer
+	frames  int
+	ipID    uint16
+}
+
+// Open creates path and path+SidecarSuffix
+func Open(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	sidecar, err := os.Create(path + SidecarSuffix)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := &Writer{f: f, w: bufio.NewWriter(f), sidecar: sidecar, events: csv.NewWriter(sidecar)}
+
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagicNanos)
+	binary.LittleEndian.PutUint16(header[4:6], 2) // version 2.4
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], snapLen)
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeEther)
+	w.w.Write(header[:])
+	w.events.Write([]string{"frame", "time", "event", "link", "detail"})
+
+	return w, w.flush()
+}
+
+// Packet writes one UDP datagram from src to dst and returns its frame
+// number, counting from 1 like Wireshark does
+func (w *Writer) Packet(t time.Time, src, dst *net.UDPAddr, payload []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ipID++
+	frame := buildFrame(src, dst, payload, w.ipID)
+
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+	w.w.Write(record[:])
+	w.w.Write(frame)
+
+	w.frames++
+	return w.frames, w.flush()
+}
+
+// Annotate records an event for a frame in the sidecar
+func (w *Writer) Annotate(frame int, t time.Time, event, link, detail string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.events.Write([]string{strconv.Itoa(frame), t.Format(time.RFC3339Nano), event, link, detail})
+	return w.flush()
+}
+
+// flush pushes everything to disk so a killed proxy leaves a readable
+// capture, caller holds w.mu
+func (w *Writer) flush() error {
+	w.events.Flush()
+	if err := w.events.Error(); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.sidecar.Close()
+	return w.f.Close()
+}
+
+func (w *Writer) Path() string {
+	return w.f.Name()
+}
+
+// buildFrame wraps payload in Ethernet, IPv4 or IPv6 and UDP headers
+func buildFrame(src, dst *net.UDPAddr, payload []byte, ipID uint16) []byte {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v4 := srcIP != nil && dstIP != nil
+	if !v4 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	ipSize := ipv6HeaderSize
+	if v4 {
+		ipSize = ipv4HeaderSize
+	}
+	udpLen := udpHeaderSize + len(payload)
+	frame := make([]byte, etherHeaderSize+ipSize+udpLen)
+
+	// locally administered MACs derived from the IP addresses
+	eth := frame[:etherHeaderSize]
+	copy(eth[0:6], macFor(dstIP))
+	copy(eth[6:12], macFor(srcIP))
+
+	ip := frame[etherHeaderSize : etherHeaderSize+ipSize]
+	if v4 {
+		binary.BigEndian.PutUint16(eth[12:14], 0x0800)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipSize+udpLen))
+		binary.BigEndian.PutUint16(ip[4:6], ipID)
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+		ip[8] = 64
+		ip[9] = 17 // UDP
+		copy(ip[12:16], srcIP)
+		copy(ip[16:20], dstIP)
+		binary.BigEndian.PutUint16(ip[10:12], ^fold(sum(ip)))
+	} else {
+		binary.BigEndian.PutUint16(eth[12:14], 0x86dd)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:24], srcIP)
+		copy(ip[24:40], dstIP)
+	}
+
+	udp := frame[etherHeaderSize+ipSize:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[udpHeaderSize:], payload)
+
+	// checksum over the pseudo header and the UDP datagram
+	var pseudo []byte
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	pseudo = append(pseudo, 0, 17, byte(udpLen>>8), byte(udpLen))
+	checksum := ^fold(sum(pseudo) + sum(udp))
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
+	return frame
+}
+
+func macFor(ip net.IP) []byte {
+	mac := []byte{0x02, 0x00, 0, 0, 0, 0}
+	copy(mac[2:], ip[len(ip)-4:])
+	return mac
+}
+
+// sum adds b as big endian 16-bit words for the Internet checksum
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+func (w *Writer) String() string {
+	return fmt.Sprintf("capture %s (annotations in %s)", w.f.Name(), w.sidecar.Name())
+}
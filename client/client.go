@@ -3,10 +3,10 @@ package main
 import (
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
 	"go-network-mini-project/config"
+	"go-network-mini-project/protocol"
 )
 
 func main() {
@@ -38,7 +38,7 @@ func main() {
 	fmt.Println("waiting for packets (normal listening)...")
 
 	// receive packets (normal listening)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, protocol.MaxPacketSize)
 	packetCount := 0
 
 	for {
@@ -49,30 +49,18 @@ func main() {
 		}
 
 		packetCount++
-		message := string(buffer[:n])
-		
-		// parse packet: format is "Packet <number>|<timestamp>"
-		parts := strings.SplitN(message, "|", 2)
-		if len(parts) == 2 {
-			packetInfo := parts[0]
-			timestampStr := parts[1]
-			
-			// parse timestamp
-			sendTime, err := time.Parse(time.RFC3339Nano, timestampStr)
-			if err != nil {
-				fmt.Printf("parse timestamp failed: %v\n", err)
-				fmt.Printf("received from %s: %s (%d packet)\n", 
-					senderAddr, packetInfo, packetCount)
-			} else {
-				// calculate latency
-				latency := time.Since(sendTime)
-				fmt.Printf("received from %s: %s (%d packet, latency: %v)\n", 
-					senderAddr, packetInfo, packetCount, latency.Round(time.Microsecond))
-			}
-		} else {
-			// old format or format error
-			fmt.Printf("received from %s: %s (%d packet)\n", 
-				senderAddr, message, packetCount)
+
+		packet, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			fmt.Printf("decode packet failed: %v\n", err)
+			fmt.Printf("received from %s: %d bytes (%d packet)\n",
+				senderAddr, n, packetCount)
+			continue
 		}
+
+		// calculate latency from the header timestamp
+		latency := time.Since(packet.SendTime())
+		fmt.Printf("received from %s: %s (%d packet, latency: %v)\n",
+			senderAddr, packet.Header, packetCount, latency.Round(time.Microsecond))
 	}
 }
@@ -3,11 +3,21 @@ package main
 import (
 	"fmt"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go-network-mini-project/config"
+	"go-network-mini-project/protocol"
+)
+
+const (
+	finRetryInterval = 500 * time.Millisecond
+	maxFINRetries    = 20
+	finLinger        = 1 * time.Second        // stay around after FIN-ACK to absorb late packets
+	ceEchoInterval   = 100 * time.Millisecond // fastest a CE mark triggers an extra ACK
+	tailLossTimeout  = 1 * time.Second        // silence after which the missing tail is NACKed
+	tailLossGaps     = 4                      // ... or this many average packet gaps, if longer
 )
 
 type ReorderBuffer struct {
@@ -16,48 +26,132 @@ type ReorderBuffer struct {
 	expectedSeqNum   int
 	receivedCount    int
 	processedCount   int
+	corruptCount     int
+	duplicateCount   int
+	ceCount          int // CE marked data packets, echoed in every ACK
+	lastDataTime     time.Time
+	lastHeard        time.Time     // accepted HELLO or latest data packet, the tail probe's idle clock
+	arrivalGap       time.Duration // moving average of the time between data packets
+	tailProbes       int
+	ackLastSentTime  time.Time
 	lostPackets      map[int]bool
 	nackSent         map[int]bool
 	nackLastSentTime map[int]time.Time
-	totalPackets     int
+	totalPackets     int // 0 means unbounded, learned from HELLO
+	payloadSize      int
 	completed        bool
+	started          bool
+	sessionID        uint32
+	clientID         uint32
+	finLastSentTime  time.Time
+	finRetries       int
+	finAcked         bool
+	finished         bool
+	done             chan struct{} // closed once the client may exit
 }
 
 type PacketData struct {
 	seqNum    int
-	message   string
+	payload   []byte
 	timestamp time.Time
 	recvTime  time.Time
 }
 
-func NewReorderBuffer() *ReorderBuffer {
+func NewReorderBuffer(clientID uint32) *ReorderBuffer {
 	return &ReorderBuffer{
+		clientID:         clientID,
 		buffer:           make(map[int]PacketData),
 		expectedSeqNum:   1,
 		lostPackets:      make(map[int]bool),
 		nackSent:         make(map[int]bool),
 		nackLastSentTime: make(map[int]time.Time),
-		totalPackets:     10000,
 		completed:        false,
+		done:             make(chan struct{}),
 	}
 }
 
-func (rb *ReorderBuffer) processPacket(seqNum int, message string, timestamp time.Time, recvTime time.Time, conn *net.UDPConn, senderAddr *net.UDPAddr) {
+// handleHello takes the stream parameters from the server's HELLO and
+// confirms it. HELLO is resent until acked, so repeats are acked again
+func (rb *ReorderBuffer) handleHello(packet *protocol.Packet, conn *net.UDPConn, senderAddr *net.UDPAddr) {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
+	hello, err := protocol.ParseHello(packet)
+	if err != nil {
+		fmt.Printf("[Client 1] parse HELLO failed: %v\n", err)
+		return
+	}
+	if hello.Version != protocol.Version {
+		fmt.Printf("[Client 1] HELLO with unsupported version %d (ignored)\n", hello.Version)
+		return
+	}
+
+	if !rb.started {
+		rb.started = true
+		rb.sessionID = packet.SessionID
+		rb.totalPackets = int(hello.TotalPackets)
+		rb.payloadSize = int(hello.PayloadSize)
+		// a stream whose data is all lost still gets its tail probed
+		rb.lastHeard = time.Now()
+
+		total := "unbounded"
+		if hello.TotalPackets != protocol.Unbounded {
+			total = fmt.Sprintf("%d", hello.TotalPackets)
+		}
+		fmt.Printf("[Client 1] HELLO: session %08x, total packets %s, payload size %d\n",
+			rb.sessionID, total, rb.payloadSize)
+	} else if packet.SessionID != rb.sessionID {
+		fmt.Printf("[Client 1] HELLO for other session %08x (ignored)\n", packet.SessionID)
+		return
+	} else if rb.totalPackets == 0 && hello.TotalPackets != protocol.Unbounded {
+		// an unbounded (duration mode) stream announces its final count when it stops
+		rb.totalPackets = int(hello.TotalPackets)
+		fmt.Printf("[Client 1] HELLO: stream ends after %d packets\n", rb.totalPackets)
+		rb.checkCompletion(conn, senderAddr)
+	}
+
+	ackMsg := protocol.NewHelloAck(rb.sessionID, rb.clientID).Marshal()
+	if _, err := conn.WriteToUDP(ackMsg, senderAddr); err != nil {
+		fmt.Printf("[Client 1] send HELLO-ACK failed: %v\n", err)
+	}
+}
+
+func (rb *ReorderBuffer) processPacket(packet *protocol.Packet, recvTime time.Time, conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.started || packet.SessionID != rb.sessionID {
+		fmt.Printf("[Client 1] %s without matching HELLO (ignored)\n", packet.Header)
+		return
+	}
+
+	seqNum := int(packet.Seq)
+	timestamp := packet.SendTime()
 	rb.receivedCount++
+	if !rb.lastDataTime.IsZero() {
+		rb.arrivalGap += (recvTime.Sub(rb.lastDataTime) - rb.arrivalGap) / 8
+	}
+	rb.lastDataTime = recvTime
+	rb.lastHeard = recvTime
+
+	// echo congestion marks right away instead of waiting for the next ACK
+	if packet.Flags&protocol.FlagCE != 0 {
+		rb.ceCount++
+		if time.Since(rb.ackLastSentTime) >= ceEchoInterval {
+			rb.ack(conn, senderAddr)
+		}
+	}
 
 	if seqNum == rb.expectedSeqNum {
 		// received expected packet, process it
-		rb.processAndPrint(seqNum, message, timestamp, recvTime)
+		rb.processAndPrint(seqNum, packet.Payload, timestamp, recvTime)
 		rb.expectedSeqNum++
 		rb.processedCount++
 
 		// try to process buffered packets
 		for {
 			if pkt, exists := rb.buffer[rb.expectedSeqNum]; exists {
-				rb.processAndPrint(pkt.seqNum, pkt.message, pkt.timestamp, pkt.recvTime)
+				rb.processAndPrint(pkt.seqNum, pkt.payload, pkt.timestamp, pkt.recvTime)
 				delete(rb.buffer, rb.expectedSeqNum)
 				rb.expectedSeqNum++
 				rb.processedCount++
@@ -68,33 +162,51 @@ func (rb *ReorderBuffer) processPacket(seqNum int, message string, timestamp tim
 
 		// check if all packets received
 		rb.checkCompletion(conn, senderAddr)
+	} else if _, buffered := rb.buffer[seqNum]; buffered {
+		// a copy of a packet already waiting in the buffer
+		rb.duplicateCount++
+		fmt.Printf("[Client 1] Duplicate packet: received SEQ %d again (ignored)\n", seqNum)
 	} else if seqNum > rb.expectedSeqNum {
 		// received out-of-order packet, buffer it
 		rb.buffer[seqNum] = PacketData{
 			seqNum:    seqNum,
-			message:   message,
+			payload:   packet.Payload,
 			timestamp: timestamp,
 			recvTime:  recvTime,
 		}
 		fmt.Printf("[Client 1] Out-of-order: received SEQ %d, expected %d (buffered)\n", seqNum, rb.expectedSeqNum)
 
-		// send NACK for missing packets (only if not already buffered and not already sent NACK)
+		// NACK missing packets (only if not already buffered and not already sent NACK),
+		// the whole gap goes out as one selective NACK
+		var missing []int
 		for i := rb.expectedSeqNum; i < seqNum; i++ {
 			// Check if packet is not in buffer and NACK not sent yet
 			_, alreadyBuffered := rb.buffer[i]
 			if !alreadyBuffered && !rb.nackSent[i] {
-				rb.sendNACK(i, conn, senderAddr)
+				missing = append(missing, i)
 				rb.nackSent[i] = true
 				rb.lostPackets[i] = true
 			}
 		}
+		rb.sendNACKs(missing, conn, senderAddr)
 	} else {
 		// received duplicate or old packet
+		rb.duplicateCount++
 		fmt.Printf("[Client 1] Duplicate/Old packet: received SEQ %d, expected %d (ignored)\n", seqNum, rb.expectedSeqNum)
 	}
 }
 
-func (rb *ReorderBuffer) processAndPrint(seqNum int, message string, timestamp time.Time, recvTime time.Time) {
+// recordCorrupt counts a packet that failed decoding or the checksum check.
+// It is dropped and treated as lost, the gap is NACKed once a later packet
+// arrives (or by retryNACKs if it was already NACKed)
+func (rb *ReorderBuffer) recordCorrupt() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.corruptCount++
+}
+
+func (rb *ReorderBuffer) processAndPrint(seqNum int, payload []byte, timestamp time.Time, recvTime time.Time) {
 	latency := recvTime.Sub(timestamp)
 	if seqNum%1000 == 0 || seqNum <= 10 {
 		fmt.Printf("[Client 1] Processed SEQ %d\n", seqNum)
@@ -104,31 +216,98 @@ func (rb *ReorderBuffer) processAndPrint(seqNum int, message string, timestamp t
 	}
 }
 
-func (rb *ReorderBuffer) sendNACK(seqNum int, conn *net.UDPConn, senderAddr *net.UDPAddr) {
-	nackMsg := fmt.Sprintf("NACK:%d", seqNum)
-	_, err := conn.WriteToUDP([]byte(nackMsg), senderAddr)
-	if err != nil {
-		fmt.Printf("[Client 1] send NACK for SEQ %d failed: %v\n", seqNum, err)
-	} else {
-		rb.nackLastSentTime[seqNum] = time.Now()
-		fmt.Printf("[Client 1] sent NACK for missing SEQ %d\n", seqNum)
+// sendNACKs coalesces the sequence numbers into ranges and sends them as
+// selective NACKs
+func (rb *ReorderBuffer) sendNACKs(seqNums []int, conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	if len(seqNums) == 0 {
+		return
+	}
+
+	for _, nack := range protocol.NewNACKs(rb.sessionID, rb.clientID, protocol.Ranges(seqNums)) {
+		ranges, _ := protocol.ParseNACK(nack)
+		_, err := conn.WriteToUDP(nack.Marshal(), senderAddr)
+		if err != nil {
+			fmt.Printf("[Client 1] send NACK for SEQ %v failed: %v\n", ranges, err)
+			continue
+		}
+
+		now := time.Now()
+		for _, r := range ranges {
+			for seq := r.First; seq <= r.Last; seq++ {
+				rb.nackLastSentTime[int(seq)] = now
+			}
+		}
+		fmt.Printf("[Client 1] sent NACK for missing SEQ %v\n", ranges)
 	}
 }
 
 func (rb *ReorderBuffer) checkCompletion(conn *net.UDPConn, senderAddr *net.UDPAddr) {
-	if !rb.completed && rb.processedCount >= rb.totalPackets {
+	if !rb.completed && rb.totalPackets != 0 && rb.processedCount >= rb.totalPackets {
 		rb.completed = true
 		fmt.Printf("\n[Client 1] === ALL PACKETS RECEIVED ===\n")
 		rb.printStats()
 
-		// send FIN to server
-		finMsg := "FIN"
-		_, err := conn.WriteToUDP([]byte(finMsg), senderAddr)
-		if err != nil {
-			fmt.Printf("[Client 1] send FIN failed: %v\n", err)
-		} else {
-			fmt.Printf("[Client 1] sent FIN to server\n")
-		}
+		// send FIN to server, retryFIN resends it until FIN-ACK
+		rb.sendFIN(conn, senderAddr)
+	}
+}
+
+func (rb *ReorderBuffer) sendFIN(conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.finLastSentTime = time.Now()
+	finMsg := protocol.NewFIN(rb.sessionID, rb.clientID).Marshal()
+	_, err := conn.WriteToUDP(finMsg, senderAddr)
+	if err != nil {
+		fmt.Printf("[Client 1] send FIN failed: %v\n", err)
+	} else {
+		fmt.Printf("[Client 1] sent FIN to server\n")
+	}
+}
+
+// retryFIN resends the FIN until the server confirms it, after
+// maxFINRetries the client gives up and exits anyway
+func (rb *ReorderBuffer) retryFIN(conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.completed || rb.finAcked || rb.finished {
+		return
+	}
+	if time.Since(rb.finLastSentTime) < finRetryInterval {
+		return
+	}
+
+	if rb.finRetries >= maxFINRetries {
+		fmt.Printf("[Client 1] no FIN-ACK after %d retries, giving up\n", rb.finRetries)
+		rb.finish()
+		return
+	}
+
+	rb.finRetries++
+	rb.sendFIN(conn, senderAddr)
+}
+
+// handleFinAck ends the FIN wait and starts lingering before exit
+func (rb *ReorderBuffer) handleFinAck(packet *protocol.Packet) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.completed || rb.finAcked || packet.SessionID != rb.sessionID {
+		return
+	}
+
+	rb.finAcked = true
+	fmt.Printf("[Client 1] received FIN-ACK, lingering %v before exit\n", finLinger)
+	time.AfterFunc(finLinger, func() {
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+		rb.finish()
+	})
+}
+
+func (rb *ReorderBuffer) finish() {
+	if !rb.finished {
+		rb.finished = true
+		close(rb.done)
 	}
 }
 
@@ -144,15 +323,13 @@ func (rb *ReorderBuffer) retryNACKs(conn *net.UDPConn, senderAddr *net.UDPAddr)
 	retryInterval := 500 * time.Millisecond
 
 	// Retry NACK for missing packets between expectedSeqNum and first buffered packet
+	var retry []int
 	for i := rb.expectedSeqNum; i < rb.expectedSeqNum+100; i++ {
 		_, inBuffer := rb.buffer[i]
 		if !inBuffer && rb.nackSent[i] {
 			lastSent, exists := rb.nackLastSentTime[i]
 			if !exists || now.Sub(lastSent) > retryInterval {
-				// Retry NACK
-				nackMsg := fmt.Sprintf("NACK:%d", i)
-				conn.WriteToUDP([]byte(nackMsg), senderAddr)
-				rb.nackLastSentTime[i] = now
+				retry = append(retry, i)
 			}
 		}
 		// Stop if we find a buffered packet (packets beyond might not be lost yet)
@@ -160,6 +337,67 @@ func (rb *ReorderBuffer) retryNACKs(conn *net.UDPConn, senderAddr *net.UDPAddr)
 			break
 		}
 	}
+	rb.sendNACKs(retry, conn, senderAddr)
+}
+
+// probeTail NACKs every missing packet up to the end of the stream once no
+// data arrived for a while. Without it a lost tail is never noticed: no
+// later packet shows the gap and retryNACKs only repeats sent NACKs
+func (rb *ReorderBuffer) probeTail(conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.started || rb.completed || rb.totalPackets == 0 {
+		return
+	}
+	idle := time.Since(rb.lastHeard)
+	if idle < max(tailLossTimeout, tailLossGaps*rb.arrivalGap) {
+		return
+	}
+
+	now := time.Now()
+	var missing []int
+	for i := rb.expectedSeqNum; i <= rb.totalPackets; i++ {
+		if _, inBuffer := rb.buffer[i]; inBuffer {
+			continue
+		}
+		// packets NACKed just now get their chance to arrive first
+		if lastSent, exists := rb.nackLastSentTime[i]; exists && now.Sub(lastSent) < tailLossTimeout {
+			continue
+		}
+		missing = append(missing, i)
+		rb.nackSent[i] = true
+		rb.lostPackets[i] = true
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	rb.tailProbes++
+	fmt.Printf("[Client 1] no data for %v, NACKing %d missing packets up to SEQ %d\n",
+		idle.Round(time.Millisecond), len(missing), rb.totalPackets)
+	rb.sendNACKs(missing, conn, senderAddr)
+}
+
+// sendAck reports the cumulative position so the server can free its
+// retransmission cache
+func (rb *ReorderBuffer) sendAck(conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.started || rb.completed {
+		return
+	}
+	rb.ack(conn, senderAddr)
+}
+
+// ack sends the cumulative ACK with the CE count, caller holds rb.mu
+func (rb *ReorderBuffer) ack(conn *net.UDPConn, senderAddr *net.UDPAddr) {
+	rb.ackLastSentTime = time.Now()
+	ackMsg := protocol.NewAck(rb.sessionID, rb.clientID, uint32(rb.expectedSeqNum), uint32(rb.ceCount)).Marshal()
+	if _, err := conn.WriteToUDP(ackMsg, senderAddr); err != nil {
+		fmt.Printf("[Client 1] send ACK for SEQ %d failed: %v\n", rb.expectedSeqNum, err)
+	}
 }
 
 func (rb *ReorderBuffer) printStats() {
@@ -168,6 +406,10 @@ func (rb *ReorderBuffer) printStats() {
 	fmt.Printf("  Total Processed: %d\n", rb.processedCount)
 	fmt.Printf("  Buffered Packets: %d\n", len(rb.buffer))
 	fmt.Printf("  Lost Packets Detected: %d\n", len(rb.lostPackets))
+	fmt.Printf("  Corrupt Packets: %d\n", rb.corruptCount)
+	fmt.Printf("  Duplicate Packets: %d\n", rb.duplicateCount)
+	fmt.Printf("  CE Marked Packets: %d\n", rb.ceCount)
+	fmt.Printf("  Tail Loss Probes: %d\n", rb.tailProbes)
 	fmt.Printf("  Expected Next: %d\n", rb.expectedSeqNum)
 }
 
@@ -196,12 +438,20 @@ func main() {
 	}
 	defer conn.Close()
 
-	fmt.Printf("UDP Client 1 started, listening on: %s\n", clientAddr)
+	clientIDs, err := clientConfig.ClientIDs()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	clientID := clientIDs[0]
+
+	fmt.Printf("UDP Client 1 started, listening on: %s (client ID %d)\n", clientAddr, clientID)
 	fmt.Println("waiting for packets with reordering and loss recovery...")
 
-	reorderBuf := NewReorderBuffer()
-	buffer := make([]byte, 1024)
-	var lastSenderAddr *net.UDPAddr
+	reorderBuf := NewReorderBuffer(clientID)
+	buffer := make([]byte, protocol.MaxPacketSize)
+	// written by the read loop, read by the retry and ACK goroutines
+	var lastSenderAddr atomic.Pointer[net.UDPAddr]
 
 	// periodically print stats
 	go func() {
@@ -219,43 +469,63 @@ func main() {
 		ticker := time.NewTicker(500 * time.Millisecond)
 		defer ticker.Stop()
 		for range ticker.C {
-			if lastSenderAddr != nil {
-				reorderBuf.retryNACKs(conn, lastSenderAddr)
+			if senderAddr := lastSenderAddr.Load(); senderAddr != nil {
+				reorderBuf.retryNACKs(conn, senderAddr)
+				reorderBuf.probeTail(conn, senderAddr)
+				reorderBuf.retryFIN(conn, senderAddr)
+			}
+		}
+	}()
+
+	// periodically acknowledge everything received in order
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if senderAddr := lastSenderAddr.Load(); senderAddr != nil {
+				reorderBuf.sendAck(conn, senderAddr)
 			}
 		}
 	}()
 
 	for {
+		select {
+		case <-reorderBuf.done:
+			fmt.Printf("[Client 1] transfer finished, exiting\n")
+			return
+		default:
+		}
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 		n, senderAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// timeout is expected, check done again
+				continue
+			}
 			fmt.Printf("read UDP data failed: %v\n", err)
 			continue
 		}
 
-		lastSenderAddr = senderAddr
+		lastSenderAddr.Store(senderAddr)
 		recvTime := time.Now()
-		message := string(buffer[:n])
-
-		// parse packet: format is "SEQ:<number>|<timestamp>"
-		parts := strings.SplitN(message, "|", 2)
-		if len(parts) == 2 && strings.HasPrefix(parts[0], "SEQ:") {
-			var seqNum int
-			_, err := fmt.Sscanf(parts[0], "SEQ:%d", &seqNum)
-			if err != nil {
-				fmt.Printf("[Client 1] parse sequence number failed: %v\n", err)
-				continue
-			}
 
-			timestampStr := parts[1]
-			sendTime, err := time.Parse(time.RFC3339Nano, timestampStr)
-			if err != nil {
-				fmt.Printf("[Client 1] parse timestamp failed: %v\n", err)
-				continue
-			}
+		packet, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			fmt.Printf("[Client 1] drop corrupt packet: %v\n", err)
+			reorderBuf.recordCorrupt()
+			continue
+		}
 
-			reorderBuf.processPacket(seqNum, message, sendTime, recvTime, conn, lastSenderAddr)
-		} else {
-			fmt.Printf("[Client 1] unknown packet format: %s\n", message)
+		switch packet.Type {
+		case protocol.TypeHello:
+			reorderBuf.handleHello(packet, conn, senderAddr)
+		case protocol.TypeData:
+			reorderBuf.processPacket(packet, recvTime, conn, senderAddr)
+		case protocol.TypeFinAck:
+			reorderBuf.handleFinAck(packet)
+		default:
+			fmt.Printf("[Client 1] unexpected %s packet from %s\n", packet.Type, senderAddr)
 		}
 	}
 }
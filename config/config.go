@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -12,26 +13,164 @@ type Config struct {
 	Proxy  ProxyConfig  `yaml:"proxy"`
 	Server ServerConfig `yaml:"server"`
 	Client ClientConfig `yaml:"client"`
+	Sender SenderConfig `yaml:"sender"`
 }
 
-
 type ProxyConfig struct {
-	UDPProxy1IP         string `yaml:"udp_proxy1_ip"`
-	UDPProxy2IP         string `yaml:"udp_proxy2_ip"`
-	UDPProxy1ListenPort string `yaml:"udp_proxy1_listen_port"`
-	UDPProxy2ListenPort string `yaml:"udp_proxy2_listen_port"`
+	FlowIdleTimeout time.Duration `yaml:"flow_idle_timeout"` // a flow without traffic is forgotten after this, default 30s
+	// every proxy the binary can run, selected by name with -name. The
+	// server sends through proxy1 and proxy2
+	Proxies map[string]ProxyInstance `yaml:"proxies"`
+}
+
+// ProxyInstance is the part of the config one proxy process uses
+type ProxyInstance struct {
+	ListenIP   string `yaml:"listen_ip"`
+	ListenPort string `yaml:"listen_port"`
+	// clients the proxy relays to, one transfer per client at a time
+	Clients    []string         `yaml:"clients"`
+	Impairment ImpairmentConfig `yaml:"impairment"`
+	// reverse impairs the control packets clients send to the server
+	ReverseImpairment ImpairmentConfig `yaml:"reverse_impairment"`
+	// schedules replace the impairment above phase by phase while a run goes on
+	Schedule        ScheduleConfig `yaml:"schedule"`
+	ReverseSchedule ScheduleConfig `yaml:"reverse_schedule"`
+	Seed            int64          `yaml:"seed"`    // makes the impairment decisions reproducible, 0 picks one from the clock
+	Control         string         `yaml:"control"` // local address of the control API, e.g. "127.0.0.1:7406", empty = off
+	// pcap file of every datagram the proxy handles, empty = off. What
+	// happened to each packet goes to <file>.events.csv
+	Capture string `yaml:"capture"`
+	// faults injected into exactly the packets a rule matches
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig injects a fault into the packets it matches, on top of the
+// random impairment. Empty match fields match everything
+type RuleConfig struct {
+	Direction  string        `yaml:"direction,omitempty"`  // forward (server->client) or reverse
+	Type       string        `yaml:"type,omitempty"`       // DATA, NACK, FIN, HELLO, HELLO-ACK, ACK or FIN-ACK
+	Seq        string        `yaml:"seq,omitempty"`        // "10000", "100-200" or "9000-"
+	Retransmit *bool         `yaml:"retransmit,omitempty"` // only retransmissions, or only first transmissions
+	Nth        string        `yaml:"nth,omitempty"`        // occurrences of the same seq to act on, e.g. "1", "2-3"
+	Action     string        `yaml:"action"`               // drop, delay, duplicate or corrupt
+	Delay      time.Duration `yaml:"delay,omitempty"`      // for delay
+}
+
+// ScheduleConfig is a list of timed phases, the clock starts with the first
+// packet from the server. After the last phase the link goes back to its
+// base impairment, unless Loop is set or the last phase has no duration
+type ScheduleConfig struct {
+	Loop   bool            `yaml:"loop"`
+	Phases []SchedulePhase `yaml:"phases"`
+}
+
+// SchedulePhase sets the whole impairment of a link for Duration, fields left
+// out are off (an empty impairment forwards untouched)
+type SchedulePhase struct {
+	Name       string           `yaml:"name"`
+	Duration   time.Duration    `yaml:"duration"`
+	Impairment ImpairmentConfig `yaml:"impairment"`
+}
+
+// ImpairmentConfig describes how a proxy degrades the link, rates are
+// probabilities between 0 and 1. An empty block forwards everything untouched
+type ImpairmentConfig struct {
+	LossRate       float64               `yaml:"loss_rate"`
+	GilbertElliott *GilbertElliottConfig `yaml:"gilbert_elliott"` // bursty loss, replaces loss_rate
+	Delay          DelayConfig           `yaml:"delay"`
+	DuplicateRate  float64               `yaml:"duplicate_rate"`
+	DuplicateDelay time.Duration         `yaml:"duplicate_delay"` // the duplicate follows the original this much later, 0 = back to back
+	CorruptRate    float64               `yaml:"corrupt_rate"`
+	CorruptBits    int                   `yaml:"corrupt_bits"`  // bits flipped in a corrupted packet, default 1
+	TruncateRate   float64               `yaml:"truncate_rate"` // cut the datagram short at a random length
+	ReorderRate    float64               `yaml:"reorder_rate"`
+	ReorderDelay   time.Duration         `yaml:"reorder_delay"` // how long a reordered packet is held back, default 20ms
+	Bandwidth      BandwidthConfig       `yaml:"bandwidth"`
+	Trace          TraceConfig           `yaml:"trace"`
+	// further stages applied in order after the settings above, e.g. a
+	// second loss model behind a delay. bandwidth and trace.record only
+	// apply to the whole link and are rejected here
+	Chain []ImpairmentConfig `yaml:"chain,omitempty"`
+}
+
+// TraceConfig replays recorded per-packet outcomes or records them. A trace
+// is CSV with an "outcome,delay_us" header (more columns are ignored) or
+// JSONL with the same keys when the file ends in .jsonl
+type TraceConfig struct {
+	Replay string `yaml:"replay"` // trace applied packet by packet, replaces loss and delay
+	Loop   bool   `yaml:"loop"`   // start the replay over at its end, otherwise later packets pass untouched
+	Record string `yaml:"record"` // write the outcome of every packet on this link, only read from the base impairment
+}
+
+// BandwidthConfig turns the link into a bottleneck: a token bucket drains a
+// bounded FIFO queue at the given rate, arrivals to a full queue are dropped
+type BandwidthConfig struct {
+	RateBps      int64       `yaml:"rate_bps"`      // bottleneck rate in bits/s, 0 = unlimited
+	BurstBytes   int         `yaml:"burst_bytes"`   // token bucket depth, default 1500
+	QueuePackets int         `yaml:"queue_packets"` // queue limit in packets
+	QueueBytes   int         `yaml:"queue_bytes"`   // queue limit in bytes, with neither limit set the queue holds 100 packets
+	Discipline   string      `yaml:"discipline"`    // droptail (default), red or codel
+	RED          REDConfig   `yaml:"red"`
+	CoDel        CoDelConfig `yaml:"codel"`
+	QueueLog     string      `yaml:"queue_log"`     // CSV file receiving queue length and sojourn samples every 100ms
+	ECNThreshold int         `yaml:"ecn_threshold"` // mark data packets CE while the queue holds at least this many packets, 0 = off
+}
+
+// REDConfig tunes Random Early Detection, thresholds are in packets of the
+// averaged queue length
+type REDConfig struct {
+	MinThreshold int     `yaml:"min_threshold"` // default 5
+	MaxThreshold int     `yaml:"max_threshold"` // default 15
+	MaxP         float64 `yaml:"max_p"`         // drop probability at max_threshold, default 0.1
+	Weight       float64 `yaml:"weight"`        // EWMA weight of the average, default 0.002
+}
+
+// CoDelConfig tunes Controlled Delay (RFC 8289)
+type CoDelConfig struct {
+	Target   time.Duration `yaml:"target"`   // acceptable standing queue delay, default 5ms
+	Interval time.Duration `yaml:"interval"` // window to detect a standing queue, default 100ms
+}
+
+// GilbertElliottConfig is a two-state loss model: the link alternates between
+// a good and a bad state, each with its own loss probability
+type GilbertElliottConfig struct {
+	PGoodToBad float64 `yaml:"p_good_to_bad"` // per-packet chance of entering the bad state
+	PBadToGood float64 `yaml:"p_bad_to_good"` // per-packet chance of leaving it
+	LossGood   float64 `yaml:"loss_good"`     // loss probability in the good state, usually 0
+	LossBad    float64 `yaml:"loss_bad"`      // loss probability in the bad state, usually close to 1
+}
+
+type DelayConfig struct {
+	Distribution string        `yaml:"distribution"` // constant, uniform, normal or pareto
+	Probability  float64       `yaml:"probability"`  // share of packets delayed, 0 means all
+	Base         time.Duration `yaml:"base"`
+	Jitter       time.Duration `yaml:"jitter"`       // spread (uniform), stddev (normal) or mean tail (pareto)
+	ParetoShape  float64       `yaml:"pareto_shape"` // default 2
 }
 
 type ServerConfig struct {
-	ServerIP   string `yaml:"server_ip"`
-	ServerListenPort string `yaml:"server_listen_port"`
+	ServerIP             string `yaml:"server_ip"`
+	ServerListenPort     string `yaml:"server_listen_port"`
+	RetransmitCacheLimit int    `yaml:"retransmit_cache_limit"`
 }
 
 type ClientConfig struct {
-	ClientIP   string `yaml:"client_ip"`
-	ClientListenPort string `yaml:"client_listen_port"`
-	Client1ListenPort string `yaml:"client1_listen_port"`
-	Client2ListenPort string `yaml:"client2_listen_port"`
+	ClientIP          string  `yaml:"client_ip"`
+	ClientListenPort  string  `yaml:"client_listen_port"`
+	Client1ListenPort string  `yaml:"client1_listen_port"`
+	Client2ListenPort string  `yaml:"client2_listen_port"`
+	Client1ID         *uint32 `yaml:"client1_id"` // unset = 1, read through ClientIDs
+	Client2ID         *uint32 `yaml:"client2_id"` // unset = 2
+}
+
+// SenderConfig holds the server's run parameters, zero values fall back to
+// the server defaults and every field can be overridden by a flag
+type SenderConfig struct {
+	PacketCount     int           `yaml:"packet_count"`
+	Interval        time.Duration `yaml:"interval"`
+	PayloadSize     int           `yaml:"payload_size"`
+	Duration        time.Duration `yaml:"duration"` // send for this long instead of packet_count
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -73,6 +212,15 @@ func (c *Config) GetProxyConfig() ProxyConfig {
 	return c.Proxy
 }
 
+// GetProxyInstance returns the settings of the named proxy under proxies
+func (c *Config) GetProxyInstance(name string) (ProxyInstance, error) {
+	p, ok := c.Proxy.Proxies[name]
+	if !ok {
+		return ProxyInstance{}, fmt.Errorf("no proxy named %s in the config", name)
+	}
+	return p, nil
+}
+
 func (c *Config) GetServerConfig() ServerConfig {
 	return c.Server
 }
@@ -81,3 +229,26 @@ func (c *Config) GetClientConfig() ClientConfig {
 	return c.Client
 }
 
+// ClientIDs returns the IDs of client1 and client2. The server tracks
+// clients by the ID in their control messages, so the IDs must be unique
+// and non-zero
+func (c ClientConfig) ClientIDs() ([2]uint32, error) {
+	ids := [2]uint32{1, 2}
+	for i, id := range []*uint32{c.Client1ID, c.Client2ID} {
+		if id == nil {
+			continue
+		}
+		if *id == 0 {
+			return ids, fmt.Errorf("client%d_id must not be 0", i+1)
+		}
+		ids[i] = *id
+	}
+	if ids[0] == ids[1] {
+		return ids, fmt.Errorf("client1_id and client2_id are both %d, they must differ", ids[0])
+	}
+	return ids, nil
+}
+
+func (c *Config) GetSenderConfig() SenderConfig {
+	return c.Sender
+}
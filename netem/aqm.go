@@ -0,0 +1,222 @@
+package netem
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+// aqm is the queue discipline of a bottleneck. enqueue may drop a packet
+// early on arrival (RED), dequeue may drop it on departure based on how
+// long it waited (CoDel)
+type aqm interface {
+	enqueue(queuePackets int, now time.Time) (drop bool)
+	dequeue(sojourn time.Duration, backlogBytes int, now time.Time) (drop bool)
+	state() string
+	String() string
+}
+
+func newAQM(cfg config.BandwidthConfig, rng *rand.Rand, rate float64) (aqm, error) {
+	switch cfg.Discipline {
+	case "", "droptail":
+		return dropTail{}, nil
+	case "red":
+		return newRED(cfg.RED, rng, rate)
+	case "codel":
+		return newCoDel(cfg.CoDel)
+	default:
+		return nil, fmt.Errorf("unknown queue discipline %q", cfg.Discipline)
+	}
+}
+
+// dropTail never drops early, only a full queue drops
+type dropTail struct{}
+
+func (dropTail) enqueue(int, time.Time) bool                { return false }
+func (dropTail) dequeue(time.Duration, int, time.Time) bool { return false }
+func (dropTail) state() string                              { return "" }
+func (dropTail) String() string                             { return "drop-tail" }
+
+// red is Random Early Detection (Floyd and Jacobson): the drop probability
+// grows linearly with the averaged queue length between the thresholds
+type red struct {
+	minThreshold float64
+	maxThreshold float64
+	maxP         float64
+	weight       float64
+	rng          *rand.Rand
+	packetTime   time.Duration // time to send a typical packet, decays avg while idle
+
+	avg       float64
+	count     int // packets since the last early drop
+	idleSince time.Time
+}
+
+func newRED(cfg config.REDConfig, rng *rand.Rand, rate float64) (*red, error) {
+	r := &red{
+		minThreshold: float64(cfg.MinThreshold),
+		maxThreshold: float64(cfg.MaxThreshold),
+		maxP:         cfg.MaxP,
+		weight:       cfg.Weight,
+		rng:          rng,
+		packetTime:   time.Duration(defaultBurstBytes / rate * float64(time.Second)),
+	}
+	if r.minThreshold == 0 {
+		r.minThreshold = 5
+	}
+	if r.maxThreshold == 0 {
+		r.maxThreshold = 15
+	}
+	if r.maxP == 0 {
+		r.maxP = 0.1
+	}
+	if r.weight == 0 {
+		r.weight = 0.002
+	}
+
+	switch {
+	case r.minThreshold < 0 || r.maxThreshold <= r.minThreshold:
+		return nil, fmt.Errorf("red thresholds need 0 <= min_threshold < max_threshold")
+	case r.maxP < 0 || r.maxP > 1 || r.weight < 0 || r.weight > 1:
+		return nil, fmt.Errorf("red max_p and weight must be in [0,1]")
+	}
+	return r, nil
+}
+
+func (r *red) enqueue(queuePackets int, now time.Time) bool {
+	if queuePackets == 0 && !r.idleSince.IsZero() && r.packetTime > 0 {
+		// the queue was idle, age the average as if m empty packets had been sent
+		m := float64(now.Sub(r.idleSince)) / float64(r.packetTime)
+		r.avg *= math.Pow(1-r.weight, m)
+	} else {
+		r.avg = (1-r.weight)*r.avg + r.weight*float64(queuePackets)
+	}
+	r.idleSince = time.Time{}
+
+	switch {
+	case r.avg < r.minThreshold:
+		r.count = 0
+		return false
+	case r.avg >= r.maxThreshold:
+		r.count = 0
+		return true
+	}
+
+	r.count++
+	pb := r.maxP * (r.avg - r.minThreshold) / (r.maxThreshold - r.minThreshold)
+	pa := pb / max(1-float64(r.count)*pb, 1e-9)
+	if r.rng.Float64() < pa {
+		r.count = 0
+		return true
+	}
+	return false
+}
+
+func (r *red) dequeue(_ time.Duration, backlogBytes int, now time.Time) bool {
+	if backlogBytes == 0 {
+		r.idleSince = now
+	}
+	return false
+}
+
+func (r *red) state() string {
+	return fmt.Sprintf("red avg queue %.2f packets", r.avg)
+}
+
+func (r *red) String() string {
+	return fmt.Sprintf("red (min %.0f, max %.0f, max_p %.2f, weight %.4f)",
+		r.minThreshold, r.maxThreshold, r.maxP, r.weight)
+}
+
+// codel is Controlled Delay (RFC 8289): once packets have waited longer than
+// target for a whole interval it drops at departure, at a rate that grows
+// with the square root of the drop count until the standing queue is gone
+type codel struct {
+	target   time.Duration
+	interval time.Duration
+
+	firstAboveTime time.Time
+	dropNext       time.Time
+	count          int
+	lastCount      int
+	dropping       bool
+}
+
+func newCoDel(cfg config.CoDelConfig) (*codel, error) {
+	c := &codel{target: cfg.Target, interval: cfg.Interval}
+	if c.target == 0 {
+		c.target = 5 * time.Millisecond
+	}
+	if c.interval == 0 {
+		c.interval = 100 * time.Millisecond
+	}
+	if c.target < 0 || c.interval < 0 {
+		return nil, fmt.Errorf("codel target and interval must not be negative")
+	}
+	return c, nil
+}
+
+func (c *codel) enqueue(int, time.Time) bool {
+	return false
+}
+
+func (c *codel) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(c.interval) / math.Sqrt(float64(c.count))))
+}
+
+func (c *codel) okToDrop(sojourn time.Duration, backlogBytes int, now time.Time) bool {
+	if sojourn < c.target || backlogBytes <= defaultBurstBytes {
+		c.firstAboveTime = time.Time{}
+		return false
+	}
+	if c.firstAboveTime.IsZero() {
+		c.firstAboveTime = now.Add(c.interval)
+		return false
+	}
+	return !now.Before(c.firstAboveTime)
+}
+
+func (c *codel) dequeue(sojourn time.Duration, backlogBytes int, now time.Time) bool {
+	ok := c.okToDrop(sojourn, backlogBytes, now)
+
+	if c.dropping {
+		if !ok {
+			c.dropping = false
+			return false
+		}
+		if !now.Before(c.dropNext) {
+			c.count++
+			c.dropNext = c.controlLaw(c.dropNext)
+			return true
+		}
+		return false
+	}
+
+	if !ok {
+		return false
+	}
+
+	// enter the dropping state, resume near the previous drop rate if the
+	// last episode ended recently
+	c.dropping = true
+	delta := c.count - c.lastCount
+	if delta > 1 && now.Sub(c.dropNext) < 16*c.interval {
+		c.count = delta
+	} else {
+		c.count = 1
+	}
+	c.lastCount = c.count
+	c.dropNext = c.controlLaw(now)
+	return true
+}
+
+func (c *codel) state() string {
+	return fmt.Sprintf("codel dropping=%v count %d", c.dropping, c.count)
+}
+
+func (c *codel) String() string {
+	return fmt.Sprintf("codel (target %v, interval %v)", c.target, c.interval)
+}
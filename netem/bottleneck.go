@@ -0,0 +1,324 @@
+package netem
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+const (
+	defaultBurstBytes   = 1500
+	defaultQueuePackets = 100
+
+	queueSampleInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrTailDrop  = errors.New("tail-dropped")
+	ErrEarlyDrop = errors.New("early-dropped")
+)
+
+// Bottleneck emulates a link of limited capacity: packets wait in a bounded
+// FIFO queue and leave it as fast as a token bucket allows. A packet that
+// does not fit into the queue is tail-dropped, the queue discipline may drop
+// earlier
+type Bottleneck struct {
+	rate         float64 // bytes per second
+	burst        float64
+	queuePackets int
+	queueBytes   int
+	aqm          aqm
+	ecnThreshold int
+	rng          *rand.Rand
+
+	mu          sync.Mutex
+	queue       []queuedPacket
+	queuedBytes int
+	tokens      float64
+	lastRefill  time.Time
+	counts      QueueCounts
+	notify      chan struct{}
+}
+
+type queuedPacket struct {
+	size     int
+	enqueued time.Time
+	release  func(dropped bool)
+}
+
+// QueueCounts is a snapshot of the bottleneck queue
+type QueueCounts struct {
+	Enqueued        int
+	Sent            int
+	TailDropped     int
+	EarlyDropped    int // dropped by RED on arrival or CoDel at the head
+	Marked          int // CE marked instead of dropped
+	QueuePackets    int
+	QueueBytes      int
+	MaxQueuePackets int
+	MaxQueueBytes   int
+	SojournTotal    time.Duration // summed over sent packets
+	MaxSojourn      time.Duration
+	AQMState        string
+}
+
+// AvgSojourn is the mean time sent packets spent in the queue
+func (c QueueCounts) AvgSojourn() time.Duration {
+	if c.Sent == 0 {
+		return 0
+	}
+	return c.SojournTotal / time.Duration(c.Sent)
+}
+
+// NewBottleneck returns nil when the config sets no rate, the link is then
+// unlimited. rng drives RED's early drops
+func NewBottleneck(cfg config.BandwidthConfig, rng *rand.Rand) (*Bottleneck, error) {
+	if cfg.RateBps == 0 {
+		return nil, nil
+	}
+
+	b := &Bottleneck{
+		rng:        rng,
+		lastRefill: time.Now(),
+		notify:     make(chan struct{}, 1),
+	}
+	if err := b.configure(cfg); err != nil {
+		return nil, err
+	}
+	b.tokens = b.burst
+
+	if cfg.QueueLog != "" {
+		f, err := os.Create(cfg.QueueLog)
+		if err != nil {
+			return nil, err
+		}
+		go b.sample(f)
+	}
+
+	go b.run()
+	return b, nil
+}
+
+// Update changes the link settings while packets are queued, the queue
+// discipline starts over. A zero rate makes the link unlimited until the
+// next update. queue_log is only honoured by NewBottleneck
+func (b *Bottleneck) Update(cfg config.BandwidthConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.configure(cfg)
+	b.notifyRun()
+	return err
+}
+
+// CheckBandwidth validates a bandwidth block without building a bottleneck
+func CheckBandwidth(cfg config.BandwidthConfig) error {
+	if cfg.RateBps < 0 || cfg.BurstBytes < 0 || cfg.QueuePackets < 0 || cfg.QueueBytes < 0 || cfg.ECNThreshold < 0 {
+		return fmt.Errorf("bandwidth settings must not be negative")
+	}
+	if cfg.RateBps == 0 {
+		return nil
+	}
+	_, err := newAQM(cfg, nil, float64(cfg.RateBps)/8)
+	return err
+}
+
+// configure applies cfg, caller holds b.mu unless b is not shared yet
+func (b *Bottleneck) configure(cfg config.BandwidthConfig) error {
+	if err := CheckBandwidth(cfg); err != nil {
+		return err
+	}
+
+	b.rate = float64(cfg.RateBps) / 8
+	b.burst = float64(cfg.BurstBytes)
+	b.queuePackets = cfg.QueuePackets
+	b.queueBytes = cfg.QueueBytes
+	b.ecnThreshold = cfg.ECNThreshold
+	if b.burst == 0 {
+		b.burst = defaultBurstBytes
+	}
+	if b.queuePackets == 0 && b.queueBytes == 0 {
+		b.queuePackets = defaultQueuePackets
+	}
+
+	b.aqm = dropTail{}
+	if b.rate > 0 {
+		aqm, err := newAQM(cfg, b.rng, b.rate)
+		if err != nil {
+			return err
+		}
+		b.aqm = aqm
+	}
+	return nil
+}
+
+// Enqueue queues a packet of size bytes. release is called from the
+// bottleneck goroutine when the packet leaves the link, with dropped set if
+// the queue discipline dropped it at the head instead. Returns ErrTailDrop
+// or ErrEarlyDrop if the packet was not queued, release is then never called.
+// mark, nil for packets that cannot carry a congestion mark, is called
+// before queueing when the queue is past the ECN threshold
+func (b *Bottleneck) Enqueue(size int, mark func(), release func(dropped bool)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if (b.queuePackets > 0 && len(b.queue)+1 > b.queuePackets) ||
+		(b.queueBytes > 0 && b.queuedBytes+size > b.queueBytes) {
+		b.counts.TailDropped++
+		return ErrTailDrop
+	}
+	if b.aqm.enqueue(len(b.queue), now) {
+		b.counts.EarlyDropped++
+		return ErrEarlyDrop
+	}
+	if mark != nil && b.ecnThreshold > 0 && len(b.queue) >= b.ecnThreshold {
+		mark()
+		b.counts.Marked++
+	}
+
+	b.queue = append(b.queue, queuedPacket{size: size, enqueued: now, release: release})
+	b.notifyRun()
+	b.queuedBytes += size
+	b.counts.Enqueued++
+	b.counts.MaxQueuePackets = max(b.counts.MaxQueuePackets, len(b.queue))
+	b.counts.MaxQueueBytes = max(b.counts.MaxQueueBytes, b.queuedBytes)
+	return nil
+}
+
+func (b *Bottleneck) notifyRun() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Bottleneck) run() {
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.mu.Unlock()
+			<-b.notify
+			continue
+		}
+
+		// refill the bucket and wait until the head of the queue fits,
+		// a packet bigger than the bucket needs a full bucket. Without a
+		// rate the link is unlimited and the queue just drains
+		now := time.Now()
+		head := b.queue[0]
+		if b.rate > 0 {
+			b.tokens = min(b.burst, b.tokens+now.Sub(b.lastRefill).Seconds()*b.rate)
+			b.lastRefill = now
+
+			need := min(float64(head.size), b.burst)
+			if b.tokens < need {
+				wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+				b.mu.Unlock()
+				// an update may change the rate, recompute the wait then
+				select {
+				case <-time.After(wait):
+				case <-b.notify:
+				}
+				continue
+			}
+		} else {
+			b.tokens = b.burst
+			b.lastRefill = now
+		}
+
+		b.queue = b.queue[1:]
+		b.queuedBytes -= head.size
+		sojourn := now.Sub(head.enqueued)
+		if b.aqm.dequeue(sojourn, b.queuedBytes, now) {
+			// the head is dropped without using the link, try the next one
+			b.counts.EarlyDropped++
+			b.mu.Unlock()
+			head.release(true)
+			continue
+		}
+
+		b.tokens -= float64(head.size)
+		b.counts.Sent++
+		b.counts.SojournTotal += sojourn
+		b.counts.MaxSojourn = max(b.counts.MaxSojourn, sojourn)
+		b.mu.Unlock()
+
+		head.release(false)
+	}
+}
+
+// sample writes the queue length and the sojourn time of packets sent since
+// the previous sample to f every queueSampleInterval, as CSV
+func (b *Bottleneck) sample(f *os.File) {
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "time_ms,queue_packets,queue_bytes,sent,avg_sojourn_us,early_dropped,tail_dropped")
+
+	start := time.Now()
+	var last QueueCounts
+	ticker := time.NewTicker(queueSampleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c := b.Snapshot()
+		sent := c.Sent - last.Sent
+		var sojourn time.Duration
+		if sent > 0 {
+			sojourn = (c.SojournTotal - last.SojournTotal) / time.Duration(sent)
+		}
+		fmt.Fprintf(w, "%d,%d,%d,%d,%d,%d,%d\n", now.Sub(start).Milliseconds(), c.QueuePackets, c.QueueBytes,
+			sent, sojourn.Microseconds(), c.EarlyDropped-last.EarlyDropped, c.TailDropped-last.TailDropped)
+		if err := w.Flush(); err != nil {
+			fmt.Printf("queue log write failed: %v\n", err)
+			return
+		}
+		last = c
+	}
+}
+
+func (b *Bottleneck) Snapshot() QueueCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.counts
+	c.QueuePackets = len(b.queue)
+	c.QueueBytes = b.queuedBytes
+	c.AQMState = b.aqm.state()
+	return c
+}
+
+func (b *Bottleneck) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return "bottleneck unlimited"
+	}
+	limit := fmt.Sprintf("%d packets", b.queuePackets)
+	if b.queueBytes > 0 {
+		limit = fmt.Sprintf("%d bytes", b.queueBytes)
+		if b.queuePackets > 0 {
+			limit = fmt.Sprintf("%d packets/%d bytes", b.queuePackets, b.queueBytes)
+		}
+	}
+	s := fmt.Sprintf("bottleneck %.0f bit/s, burst %.0f bytes, %s queue %s", b.rate*8, b.burst, b.aqm, limit)
+	if b.ecnThreshold > 0 {
+		s += fmt.Sprintf(", ECN mark at %d packets", b.ecnThreshold)
+	}
+	return s
+}
+
+func (c QueueCounts) String() string {
+	s := fmt.Sprintf("queue enqueued %d, sent %d, tail-dropped %d, early-dropped %d, CE marked %d, length %d packets/%d bytes (max %d/%d), sojourn avg %v max %v",
+		c.Enqueued, c.Sent, c.TailDropped, c.EarlyDropped, c.Marked, c.QueuePackets, c.QueueBytes, c.MaxQueuePackets, c.MaxQueueBytes,
+		c.AvgSojourn().Round(time.Microsecond), c.MaxSojourn.Round(time.Microsecond))
+	if c.AQMState != "" {
+		s += ", " + c.AQMState
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+package netem
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+const defaultParetoShape = 2.0
+
+// delayModel draws per-packet delays from one of the supported distributions
+type delayModel struct {
+	distribution string
+	probability  float64
+	base         time.Duration
+	jitter       time.Duration
+	paretoShape  float64
+}
+
+func newDelayModel(cfg config.DelayConfig) (*delayModel, error) {
+	d := &delayModel{
+		distribution: cfg.Distribution,
+		probability:  cfg.Probability,
+		base:         cfg.Base,
+		jitter:       cfg.Jitter,
+		paretoShape:  cfg.ParetoShape,
+	}
+	if d.distribution == "" {
+		d.distribution = "constant"
+	}
+	if d.paretoShape == 0 {
+		d.paretoShape = defaultParetoShape
+	}
+
+	switch {
+	case d.distribution != "constant" && d.distribution != "uniform" &&
+		d.distribution != "normal" && d.distribution != "pareto":
+		return nil, fmt.Errorf("unknown delay distribution %q", d.distribution)
+	case d.probability < 0 || d.probability > 1:
+		return nil, fmt.Errorf("delay probability %v out of range [0,1]", d.probability)
+	case d.base < 0 || d.jitter < 0:
+		return nil, fmt.Errorf("delay base and jitter must not be negative")
+	case d.distribution == "pareto" && d.paretoShape <= 1:
+		return nil, fmt.Errorf("pareto shape must be greater than 1")
+	}
+	return d, nil
+}
+
+func (d *delayModel) enabled() bool {
+	return d.base > 0 || (d.jitter > 0 && d.distribution != "constant")
+}
+
+// sample returns the delay for one packet, 0 if it is not delayed
+func (d *delayModel) sample(rng *rand.Rand) time.Duration {
+	if !d.enabled() {
+		return 0
+	}
+	if d.probability > 0 && rng.Float64() >= d.probability {
+		return 0
+	}
+
+	var delay time.Duration
+	switch d.distribution {
+	case "constant":
+		delay = d.base
+	case "uniform":
+		delay = d.base + time.Duration((rng.Float64()*2-1)*float64(d.jitter))
+	case "normal":
+		delay = d.base + time.Duration(rng.NormFloat64()*float64(d.jitter))
+	case "pareto":
+		// scaled so the mean of the tail equals jitter
+		tail := math.Pow(1-rng.Float64(), -1/d.paretoShape) - 1
+		delay = d.base + time.Duration(tail*(d.paretoShape-1)*float64(d.jitter))
+	}
+	return max(delay, 0)
+}
+
+func (d *delayModel) String() string {
+	if !d.enabled() {
+		return "no delay"
+	}
+
+	s := fmt.Sprintf("%s delay %v", d.distribution, d.base)
+	if d.distribution != "constant" {
+		s += fmt.Sprintf(" jitter %v", d.jitter)
+	}
+	if d.probability > 0 {
+		s += fmt.Sprintf(" on %.1f%% of packets", d.probability*100)
+	}
+	return s
+}
@@ -0,0 +1,286 @@
+package netem
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+const defaultReorderDelay = 20 * time.Millisecond
+
+// Impairment is one stage of a link. Decide adds the stage's verdict for the
+// next packet to what the stages before it decided: drop it, delay it,
+// duplicate it or rewrite its contents
+type Impairment interface {
+	Decide(d *Decision)
+	String() string
+}
+
+// Decision is what happens to one packet
+type Decision struct {
+	Drop      bool
+	Delay     time.Duration // includes the hold-back of a reordered packet
+	Duplicate bool
+	// DuplicateDelay is how much later than the original the duplicate is sent
+	DuplicateDelay time.Duration
+	Corrupt        bool
+	Truncate       bool
+	Reorder        bool
+
+	mutations []func(data []byte) []byte
+}
+
+// Mutate applies the content changes the stages decided on, in chain order.
+// It may change data in place and returns the new slice
+func (d Decision) Mutate(data []byte) []byte {
+	for _, mutate := range d.mutations {
+		data = mutate(data)
+	}
+	return data
+}
+
+// Chain runs its stages in order until one drops the packet
+type Chain []Impairment
+
+func (c Chain) Decide(d *Decision) {
+	for _, stage := range c {
+		if d.Drop {
+			return
+		}
+		stage.Decide(d)
+	}
+}
+
+// Next draws the fate of the next packet
+func (c Chain) Next() Decision {
+	var d Decision
+	c.Decide(&d)
+	return d
+}
+
+func (c Chain) String() string {
+	if len(c) == 0 {
+		return "no impairment"
+	}
+	parts := make([]string, len(c))
+	for i, stage := range c {
+		parts[i] = stage.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// New builds the chain of an ImpairmentConfig block. The settings of the
+// block come first, in the order loss or trace replay, delay, reordering,
+// duplication, corruption, truncation, then the blocks listed under chain
+func New(cfg config.ImpairmentConfig, rng *rand.Rand) (Chain, error) {
+	for name, rate := range map[string]float64{
+		"duplicate_rate": cfg.DuplicateRate,
+		"corrupt_rate":   cfg.CorruptRate,
+		"truncate_rate":  cfg.TruncateRate,
+		"reorder_rate":   cfg.ReorderRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%s %v out of range [0,1]", name, rate)
+		}
+	}
+	if cfg.ReorderDelay < 0 || cfg.DuplicateDelay < 0 || cfg.CorruptBits < 0 {
+		return nil, fmt.Errorf("reorder_delay, duplicate_delay and corrupt_bits must not be negative")
+	}
+
+	var chain Chain
+	if cfg.Trace.Replay != "" {
+		if cfg.LossRate > 0 || cfg.GilbertElliott != nil || cfg.Delay != (config.DelayConfig{}) {
+			return nil, fmt.Errorf("trace replay cannot be combined with loss or delay settings")
+		}
+		trace, err := loadTrace(cfg.Trace)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, traceStage{trace})
+	}
+
+	loss, err := newLossModel(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if loss.enabled() {
+		chain = append(chain, lossStage{loss, rng})
+	}
+	delay, err := newDelayModel(cfg.Delay)
+	if err != nil {
+		return nil, err
+	}
+	if delay.enabled() {
+		chain = append(chain, delayStage{delay, rng})
+	}
+
+	if cfg.ReorderRate > 0 {
+		s := reorderStage{rate: cfg.ReorderRate, delay: cfg.ReorderDelay, rng: rng}
+		if s.delay == 0 {
+			s.delay = defaultReorderDelay
+		}
+		chain = append(chain, s)
+	}
+	if cfg.DuplicateRate > 0 {
+		chain = append(chain, duplicateStage{rate: cfg.DuplicateRate, delay: cfg.DuplicateDelay, rng: rng})
+	}
+	if cfg.CorruptRate > 0 {
+		s := corruptStage{rate: cfg.CorruptRate, bits: cfg.CorruptBits, rng: rng}
+		if s.bits == 0 {
+			s.bits = 1
+		}
+		chain = append(chain, s)
+	}
+	if cfg.TruncateRate > 0 {
+		chain = append(chain, truncateStage{rate: cfg.TruncateRate, rng: rng})
+	}
+
+	for i, stage := range cfg.Chain {
+		if stage.Bandwidth != (config.BandwidthConfig{}) || stage.Trace.Record != "" {
+			return nil, fmt.Errorf("chain stage %d: bandwidth and trace.record only apply to the whole link", i+1)
+		}
+		stages, err := New(stage, rng)
+		if err != nil {
+			return nil, fmt.Errorf("chain stage %d: %w", i+1, err)
+		}
+		chain = append(chain, stages...)
+	}
+	return chain, nil
+}
+
+// traceStage replays recorded drops and delays, past the end of a trace
+// that does not loop packets pass untouched
+type traceStage struct {
+	trace *traceReplay
+}
+
+func (s traceStage) Decide(d *Decision) {
+	step, _ := s.trace.step()
+	d.Drop = step.drop
+	d.Delay += step.delay
+}
+
+func (s traceStage) String() string {
+	return s.trace.String()
+}
+
+type lossStage struct {
+	model lossModel
+	rng   *rand.Rand
+}
+
+func (s lossStage) Decide(d *Decision) {
+	d.Drop = s.model.drop(s.rng)
+}
+
+func (s lossStage) String() string {
+	return s.model.String()
+}
+
+type delayStage struct {
+	model *delayModel
+	rng   *rand.Rand
+}
+
+func (s delayStage) Decide(d *Decision) {
+	d.Delay += s.model.sample(s.rng)
+}
+
+func (s delayStage) String() string {
+	return s.model.String()
+}
+
+// reorderStage holds packets back so that the packets behind them overtake
+type reorderStage struct {
+	rate  float64
+	delay time.Duration
+	rng   *rand.Rand
+}
+
+func (s reorderStage) Decide(d *Decision) {
+	if s.rng.Float64() < s.rate {
+		d.Reorder = true
+		d.Delay += s.delay
+	}
+}
+
+func (s reorderStage) String() string {
+	return fmt.Sprintf("%.1f%% reordering by %v", s.rate*100, s.delay)
+}
+
+type duplicateStage struct {
+	rate  float64
+	delay time.Duration
+	rng   *rand.Rand
+}
+
+func (s duplicateStage) Decide(d *Decision) {
+	if s.rng.Float64() < s.rate {
+		d.Duplicate = true
+		d.DuplicateDelay = s.delay
+	}
+}
+
+func (s duplicateStage) String() string {
+	str := fmt.Sprintf("%.1f%% duplication", s.rate*100)
+	if s.delay > 0 {
+		str += fmt.Sprintf(" after %v", s.delay)
+	}
+	return str
+}
+
+// corruptStage flips bits distinct random bits of a packet in place
+type corruptStage struct {
+	rate float64
+	bits int
+	rng  *rand.Rand
+}
+
+func (s corruptStage) Decide(d *Decision) {
+	if s.rng.Float64() >= s.rate {
+		return
+	}
+	d.Corrupt = true
+	d.mutations = append(d.mutations, func(data []byte) []byte {
+		bits := min(s.bits, len(data)*8)
+		flipped := make(map[int]bool, bits)
+		for len(flipped) < bits {
+			bit := s.rng.Intn(len(data) * 8)
+			if !flipped[bit] {
+				flipped[bit] = true
+				data[bit/8] ^= 1 << (bit % 8)
+			}
+		}
+		return data
+	})
+}
+
+func (s corruptStage) String() string {
+	return fmt.Sprintf("%.1f%% corruption (%d bits)", s.rate*100, s.bits)
+}
+
+// truncateStage cuts a packet to a random shorter length
+type truncateStage struct {
+	rate float64
+	rng  *rand.Rand
+}
+
+func (s truncateStage) Decide(d *Decision) {
+	if s.rng.Float64() >= s.rate {
+		return
+	}
+	d.Truncate = true
+	d.mutations = append(d.mutations, func(data []byte) []byte {
+		if len(data) == 0 {
+			return data
+		}
+		return data[:s.rng.Intn(len(data))]
+	})
+}
+
+func (s truncateStage) String() string {
+	return fmt.Sprintf("%.1f%% truncation", s.rate*100)
+}
@@ -0,0 +1,119 @@
+package netem
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+// outcome is what a Decision does to one packet, comparable across runs
+type outcome struct {
+	drop, duplicate, corrupt, truncate, reorder bool
+	delay, duplicateDelay                       time.Duration
+	data                                        string // the payload after Mutate
+}
+
+// run draws the fate of n packets from a chain seeded with seed
+func run(t *testing.T, cfg config.ImpairmentConfig, seed int64, n int) []outcome {
+	t.Helper()
+	chain, err := New(cfg, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	outcomes := make([]outcome, n)
+	for i := range outcomes {
+		d := chain.Next()
+		outcomes[i] = outcome{
+			drop:           d.Drop,
+			duplicate:      d.Duplicate,
+			corrupt:        d.Corrupt,
+			truncate:       d.Truncate,
+			reorder:        d.Reorder,
+			delay:          d.Delay,
+			duplicateDelay: d.DuplicateDelay,
+			data:           string(d.Mutate(bytes.Repeat([]byte{0xaa}, 64))),
+		}
+	}
+	return outcomes
+}
+
+func TestChainSameSeedSameDecisions(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ImpairmentConfig
+	}{
+		{"loss", config.ImpairmentConfig{LossRate: 0.3}},
+		{"gilbert-elliott", config.ImpairmentConfig{GilbertElliott: &config.GilbertElliottConfig{
+			PGoodToBad: 0.05, PBadToGood: 0.3, LossBad: 0.8}}},
+		{"pareto delay", config.ImpairmentConfig{Delay: config.DelayConfig{
+			Distribution: "pareto", Base: 5 * time.Millisecond, Jitter: 10 * time.Millisecond}}},
+		{"every stage", config.ImpairmentConfig{
+			LossRate:      0.1,
+			Delay:         config.DelayConfig{Distribution: "normal", Probability: 0.5, Base: 20 * time.Millisecond, Jitter: 5 * time.Millisecond},
+			ReorderRate:   0.1,
+			DuplicateRate: 0.1,
+			CorruptRate:   0.1,
+			CorruptBits:   3,
+			TruncateRate:  0.1,
+		}},
+		{"nested chain", config.ImpairmentConfig{
+			Delay: config.DelayConfig{Distribution: "uniform", Base: 5 * time.Millisecond, Jitter: 2 * time.Millisecond},
+			Chain: []config.ImpairmentConfig{{LossRate: 0.2}, {CorruptRate: 0.2}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := run(t, tt.cfg, 42, 2000)
+			second := run(t, tt.cfg, 42, 2000)
+			for i := range first {
+				if first[i] != second[i] {
+					t.Fatalf("packet %d: %+v, then %+v with the same seed", i, first[i], second[i])
+				}
+			}
+
+			// a different seed must not repeat the pattern
+			other := run(t, tt.cfg, 43, 2000)
+			for i := range first {
+				if first[i] != other[i] {
+					return
+				}
+			}
+			t.Errorf("seeds 42 and 43 gave the same %d decisions", len(first))
+		})
+	}
+}
+
+func TestREDSameSeedSameDrops(t *testing.T) {
+	drops := func(seed int64) []bool {
+		r, err := newRED(config.REDConfig{MinThreshold: 2, MaxThreshold: 10, MaxP: 0.5, Weight: 0.5},
+			rand.New(rand.NewSource(seed)), 1e6)
+		if err != nil {
+			t.Fatalf("newRED: %v", err)
+		}
+		now := time.Unix(0, 0)
+		result := make([]bool, 1000)
+		for i := range result {
+			result[i] = r.enqueue(2+i%8, now)
+			now = now.Add(time.Millisecond)
+		}
+		return result
+	}
+
+	first, second := drops(7), drops(7)
+	early := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("packet %d: early drop %v, then %v with the same seed", i, first[i], second[i])
+		}
+		if first[i] {
+			early++
+		}
+	}
+	if early == 0 {
+		t.Fatal("RED never dropped early, the test does not exercise its RNG")
+	}
+}
@@ -0,0 +1,106 @@
+package netem
+
+import (
+	"fmt"
+	"math/rand"
+
+	"go-network-mini-project/config"
+)
+
+// lossModel decides per packet whether it is lost
+type lossModel interface {
+	drop(rng *rand.Rand) bool
+	enabled() bool
+	String() string
+}
+
+func newLossModel(cfg config.ImpairmentConfig) (lossModel, error) {
+	if cfg.GilbertElliott == nil {
+		if cfg.LossRate < 0 || cfg.LossRate > 1 {
+			return nil, fmt.Errorf("loss_rate %v out of range [0,1]", cfg.LossRate)
+		}
+		return bernoulliLoss{rate: cfg.LossRate}, nil
+	}
+
+	if cfg.LossRate != 0 {
+		return nil, fmt.Errorf("loss_rate and gilbert_elliott are mutually exclusive")
+	}
+	ge := cfg.GilbertElliott
+	for name, p := range map[string]float64{
+		"p_good_to_bad": ge.PGoodToBad,
+		"p_bad_to_good": ge.PBadToGood,
+		"loss_good":     ge.LossGood,
+		"loss_bad":      ge.LossBad,
+	} {
+		if p < 0 || p > 1 {
+			return nil, fmt.Errorf("gilbert_elliott %s %v out of range [0,1]", name, p)
+		}
+	}
+	return &gilbertElliott{
+		pGoodToBad: ge.PGoodToBad,
+		pBadToGood: ge.PBadToGood,
+		lossGood:   ge.LossGood,
+		lossBad:    ge.LossBad,
+	}, nil
+}
+
+// bernoulliLoss drops every packet independently with the same probability
+type bernoulliLoss struct {
+	rate float64
+}
+
+func (l bernoulliLoss) drop(rng *rand.Rand) bool {
+	return l.rate > 0 && rng.Float64() < l.rate
+}
+
+func (l bernoulliLoss) enabled() bool {
+	return l.rate > 0
+}
+
+func (l bernoulliLoss) String() string {
+	return fmt.Sprintf("%.1f%% loss", l.rate*100)
+}
+
+// gilbertElliott is the two-state Markov loss model, it produces the loss
+// bursts seen on Wi-Fi and cellular links. The state moves once per packet
+type gilbertElliott struct {
+	pGoodToBad float64
+	pBadToGood float64
+	lossGood   float64
+	lossBad    float64
+	bad        bool
+}
+
+func (g *gilbertElliott) drop(rng *rand.Rand) bool {
+	if g.bad {
+		if rng.Float64() < g.pBadToGood {
+			g.bad = false
+		}
+	} else if rng.Float64() < g.pGoodToBad {
+		g.bad = true
+	}
+
+	loss := g.lossGood
+	if g.bad {
+		loss = g.lossBad
+	}
+	return loss > 0 && rng.Float64() < loss
+}
+
+func (g *gilbertElliott) enabled() bool {
+	return g.lossGood > 0 || (g.pGoodToBad > 0 && g.lossBad > 0)
+}
+
+// averageLoss is the long-run loss rate from the stationary distribution
+func (g *gilbertElliott) averageLoss() float64 {
+	if g.pGoodToBad+g.pBadToGood == 0 {
+		return g.lossGood
+	}
+	piBad := g.pGoodToBad / (g.pGoodToBad + g.pBadToGood)
+	return (1-piBad)*g.lossGood + piBad*g.lossBad
+}
+
+func (g *gilbertElliott) String() string {
+	return fmt.Sprintf("gilbert-elliott loss (good->bad %.3f, bad->good %.3f, loss good %.1f%% bad %.1f%%, average %.1f%%)",
+		g.pGoodToBad, g.pBadToGood, g.lossGood*100, g.lossBad*100, g.averageLoss()*100)
+}
@@ -0,0 +1,250 @@
+package netem
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-network-mini-project/config"
+	"go-network-mini-project/protocol"
+)
+
+// Rules inject faults into the exact packets they match, so edge cases like
+// losing the last packet or the FIN do not depend on luck. Every matching
+// rule acts on a packet. Safe for concurrent use, the control API replaces
+// the rules while packets flow
+type Rules struct {
+	mu    sync.Mutex
+	rules []*rule
+}
+
+type rule struct {
+	cfg      config.RuleConfig
+	typ      protocol.Type // 0 matches every type
+	seq      numRange
+	nth      numRange
+	seen     map[uint32]int // matching packets per seq so far
+	hits     int
+	mutation func(data []byte) []byte
+}
+
+// numRange is an inclusive range parsed from "5", "5-9" or "5-"
+type numRange struct {
+	from, to uint32
+}
+
+func parseRange(s string) (numRange, error) {
+	if s == "" {
+		return numRange{0, math.MaxUint32}, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	r := numRange{}
+	n, err := strconv.ParseUint(strings.TrimSpace(from), 10, 32)
+	if err != nil {
+		return r, fmt.Errorf("bad range %q", s)
+	}
+	r.from, r.to = uint32(n), uint32(n)
+	if isRange {
+		r.to = math.MaxUint32
+		if to = strings.TrimSpace(to); to != "" {
+			n, err := strconv.ParseUint(to, 10, 32)
+			if err != nil || uint32(n) < r.from {
+				return r, fmt.Errorf("bad range %q", s)
+			}
+			r.to = uint32(n)
+		}
+	}
+	return r, nil
+}
+
+func (r numRange) contains(n uint32) bool {
+	return n >= r.from && n <= r.to
+}
+
+// NewRules checks every rule, nil configs give an empty set
+func NewRules(cfgs []config.RuleConfig) (*Rules, error) {
+	rules := &Rules{}
+	return rules, rules.Replace(cfgs)
+}
+
+// Replace swaps in a new rule list, occurrence counts start over. On an
+// error the old rules stay
+func (rs *Rules) Replace(cfgs []config.RuleConfig) error {
+	var rules []*rule
+	for i, cfg := range cfgs {
+		r, err := newRule(cfg)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rules = append(rules, r)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.rules = rules
+	return nil
+}
+
+// Add appends a rule, the others keep their counts
+func (rs *Rules) Add(cfg config.RuleConfig) error {
+	r, err := newRule(cfg)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.rules = append(rs.rules, r)
+	return nil
+}
+
+func newRule(cfg config.RuleConfig) (*rule, error) {
+	r := &rule{cfg: cfg, seen: make(map[uint32]int)}
+	switch cfg.Direction {
+	case "", "forward", "reverse":
+	default:
+		return nil, fmt.Errorf("direction %q is not forward or reverse", cfg.Direction)
+	}
+	if cfg.Type != "" {
+		for t := protocol.TypeData; t <= protocol.TypeFinAck; t++ {
+			if strings.EqualFold(cfg.Type, t.String()) {
+				r.typ = t
+			}
+		}
+		if r.typ == 0 {
+			return nil, fmt.Errorf("unknown packet type %q", cfg.Type)
+		}
+	}
+
+	var err error
+	if r.seq, err = parseRange(cfg.Seq); err != nil {
+		return nil, fmt.Errorf("seq: %w", err)
+	}
+	if r.nth, err = parseRange(cfg.Nth); err != nil {
+		return nil, fmt.Errorf("nth: %w", err)
+	}
+	if r.nth.from == 0 && cfg.Nth != "" {
+		return nil, fmt.Errorf("nth counts from 1")
+	}
+
+	switch cfg.Action {
+	case "drop", "duplicate":
+	case "delay":
+		if cfg.Delay <= 0 {
+			return nil, fmt.Errorf("delay action needs a positive delay")
+		}
+	case "corrupt":
+		// flip the lowest bit of the last byte, the checksum catches it
+		r.mutation = func(data []byte) []byte {
+			if len(data) > 0 {
+				data[len(data)-1] ^= 1
+			}
+			return data
+		}
+	default:
+		return nil, fmt.Errorf("action %q is not drop, delay, duplicate or corrupt", cfg.Action)
+	}
+	return r, nil
+}
+
+// Apply lets every rule for direction that matches header act on d and
+// returns the rules that fired
+func (rs *Rules) Apply(direction string, header protocol.Header, d *Decision) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var fired []string
+	for _, r := range rs.rules {
+		if r.cfg.Direction != "" && r.cfg.Direction != direction {
+			continue
+		}
+		if r.typ != 0 && header.Type != r.typ {
+			continue
+		}
+		if !r.seq.contains(header.Seq) {
+			continue
+		}
+		if r.cfg.Retransmit != nil && *r.cfg.Retransmit != (header.Flags&protocol.FlagRetransmit != 0) {
+			continue
+		}
+		r.seen[header.Seq]++
+		if !r.nth.contains(uint32(r.seen[header.Seq])) {
+			continue
+		}
+
+		r.hits++
+		switch r.cfg.Action {
+		case "drop":
+			d.Drop = true
+		case "delay":
+			d.Delay += r.cfg.Delay
+		case "duplicate":
+			d.Duplicate = true
+		case "corrupt":
+			d.Corrupt = true
+			d.mutations = append(d.mutations, r.mutation)
+		}
+		fired = append(fired, r.String())
+	}
+	return fired
+}
+
+// RuleStatus is a rule with the number of packets it acted on
+type RuleStatus struct {
+	config.RuleConfig `yaml:",inline"`
+	Hits              int `yaml:"hits"`
+}
+
+func (rs *Rules) Status() []RuleStatus {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	status := make([]RuleStatus, len(rs.rules))
+	for i, r := range rs.rules {
+		status[i] = RuleStatus{RuleConfig: r.cfg, Hits: r.hits}
+	}
+	return status
+}
+
+func (r *rule) String() string {
+	s := r.cfg.Action
+	if r.cfg.Action == "delay" {
+		s += " " + r.cfg.Delay.String()
+	}
+	if r.cfg.Direction != "" {
+		s += " " + r.cfg.Direction
+	}
+	if r.typ != 0 {
+		s += " " + r.typ.String()
+	}
+	if r.cfg.Seq != "" {
+		s += " seq " + r.cfg.Seq
+	}
+	if r.cfg.Retransmit != nil {
+		if *r.cfg.Retransmit {
+			s += " retransmissions"
+		} else {
+			s += " first transmissions"
+		}
+	}
+	if r.cfg.Nth != "" {
+		s += " occurrence " + r.cfg.Nth
+	}
+	return s
+}
+
+func (rs *Rules) String() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(rs.rules) == 0 {
+		return "no rules"
+	}
+	parts := make([]string, len(rs.rules))
+	for i, r := range rs.rules {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,90 @@
+package netem
+
+import (
+	"fmt"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+// Schedule steps a link through timed impairment phases
+type Schedule struct {
+	loop   bool
+	phases []config.SchedulePhase
+	base   config.ImpairmentConfig
+}
+
+// Phase is one step of a schedule as handed to the apply callback
+type Phase struct {
+	Index      int // 1-based, 0 once the schedule ended and the base is back
+	Count      int
+	Name       string
+	Duration   time.Duration // 0 holds the phase until the end of the run
+	Impairment config.ImpairmentConfig
+}
+
+// NewSchedule validates every phase up front, it returns nil for a schedule
+// without phases
+func NewSchedule(cfg config.ScheduleConfig, base config.ImpairmentConfig) (*Schedule, error) {
+	if len(cfg.Phases) == 0 {
+		return nil, nil
+	}
+
+	for i, phase := range cfg.Phases {
+		last := i == len(cfg.Phases)-1
+		if phase.Duration < 0 || (phase.Duration == 0 && (!last || cfg.Loop)) {
+			return nil, fmt.Errorf("phase %d needs a positive duration", i+1)
+		}
+		if _, err := New(phase.Impairment, nil); err != nil {
+			return nil, fmt.Errorf("phase %d: %w", i+1, err)
+		}
+		if err := CheckBandwidth(phase.Impairment.Bandwidth); err != nil {
+			return nil, fmt.Errorf("phase %d: %w", i+1, err)
+		}
+	}
+	return &Schedule{loop: cfg.Loop, phases: cfg.Phases, base: base}, nil
+}
+
+// Run calls apply at every phase transition. It blocks until the schedule
+// ended, forever if it loops. Phase deadlines add up from the start so
+// they do not drift
+func (s *Schedule) Run(apply func(Phase)) {
+	next := time.Now()
+	for {
+		for i, phase := range s.phases {
+			name := phase.Name
+			if name == "" {
+				name = fmt.Sprintf("phase %d", i+1)
+			}
+			apply(Phase{
+				Index:      i + 1,
+				Count:      len(s.phases),
+				Name:       name,
+				Duration:   phase.Duration,
+				Impairment: phase.Impairment,
+			})
+			if phase.Duration == 0 {
+				return
+			}
+
+			next = next.Add(phase.Duration)
+			time.Sleep(time.Until(next))
+		}
+
+		if !s.loop {
+			apply(Phase{Count: len(s.phases), Name: "base", Impairment: s.base})
+			return
+		}
+	}
+}
+
+func (p Phase) String() string {
+	if p.Index == 0 {
+		return fmt.Sprintf("schedule ended, back to %s", p.Name)
+	}
+	length := "until the end"
+	if p.Duration > 0 {
+		length = fmt.Sprintf("for %v", p.Duration)
+	}
+	return fmt.Sprintf("phase %d/%d %q %s", p.Index, p.Count, p.Name, length)
+}
@@ -0,0 +1,112 @@
+package netem
+
+import (
+	"fmt"
+	"sync"
+)
+
+// burst length buckets: 1, 2, 3-4, 5-8, 9+
+var burstBuckets = []struct {
+	max   int
+	label string
+}{
+	{1, "1"}, {2, "2"}, {4, "3-4"}, {8, "5-8"}, {int(^uint(0) >> 1), "9+"},
+}
+
+// Counts is a snapshot of what the impairment did to the packets it saw
+type Counts struct {
+	Packets    int
+	Dropped    int
+	Delayed    int
+	Duplicated int
+	Corrupted  int
+	Truncated  int
+	Reordered  int
+
+	// a burst is a run of consecutive dropped packets
+	Bursts         int
+	MaxBurst       int
+	BurstHistogram [5]int
+}
+
+// Stats collects Counts, it is safe for concurrent use
+type Stats struct {
+	mu           sync.Mutex
+	counts       Counts
+	currentBurst int
+}
+
+func (s *Stats) Record(d Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &s.counts
+	c.Packets++
+	if d.Drop {
+		c.Dropped++
+		s.currentBurst++
+		return
+	}
+	if s.currentBurst > 0 {
+		c.addBurst(s.currentBurst)
+		s.currentBurst = 0
+	}
+
+	if d.Delay > 0 {
+		c.Delayed++
+	}
+	if d.Duplicate {
+		c.Duplicated++
+	}
+	if d.Corrupt {
+		c.Corrupted++
+	}
+	if d.Truncate {
+		c.Truncated++
+	}
+	if d.Reorder {
+		c.Reordered++
+	}
+}
+
+func (c *Counts) addBurst(length int) {
+	c.Bursts++
+	c.MaxBurst = max(c.MaxBurst, length)
+	for i, bucket := range burstBuckets {
+		if length <= bucket.max {
+			c.BurstHistogram[i]++
+			break
+		}
+	}
+}
+
+// Snapshot returns the counters, a burst still in progress is included
+func (s *Stats) Snapshot() Counts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counts
+	if s.currentBurst > 0 {
+		c.addBurst(s.currentBurst)
+	}
+	return c
+}
+
+func (c Counts) String() string {
+	return fmt.Sprintf("packets %d, dropped %d, delayed %d, duplicated %d, corrupted %d, truncated %d, reordered %d",
+		c.Packets, c.Dropped, c.Delayed, c.Duplicated, c.Corrupted, c.Truncated, c.Reordered)
+}
+
+// BurstString summarizes loss bursts: count, mean and max length, histogram
+func (c Counts) BurstString() string {
+	if c.Bursts == 0 {
+		return "no loss bursts"
+	}
+
+	s := fmt.Sprintf("loss bursts %d, mean length %.2f, max %d, histogram",
+		c.Bursts, float64(c.Dropped)/float64(c.Bursts), c.MaxBurst)
+	for i, bucket := range burstBuckets {
+		s += fmt.Sprintf(" [%s]=%d", bucket.label, c.BurstHistogram[i])
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package netem
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Timers runs callbacks at their deadlines from a single goroutine, so
+// delayed packets need no goroutine each. Callbacks with equal deadlines run
+// in the order they were added
+type Timers struct {
+	mu      sync.Mutex
+	pending timerHeap
+	added   uint64
+	maxLen  int
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+type timer struct {
+	at  time.Time
+	seq uint64 // breaks ties between equal deadlines
+	fn  func()
+}
+
+type timerHeap []timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x any)   { *h = append(*h, x.(timer)) }
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = timer{}
+	*h = old[:len(old)-1]
+	return t
+}
+
+func NewTimers() *Timers {
+	t := &Timers{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// At schedules fn for the deadline at, a deadline in the past runs as soon
+// as possible. Returns false once the timers are closed, fn then never runs
+func (t *Timers) At(at time.Time, fn func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.added++
+	heap.Push(&t.pending, timer{at: at, seq: t.added, fn: fn})
+	t.maxLen = max(t.maxLen, len(t.pending))
+	// only a new earliest deadline needs the goroutine to rearm
+	if t.pending[0].seq == t.added {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (t *Timers) run() {
+	defer close(t.done)
+
+	clock := time.NewTimer(time.Hour)
+	clock.Stop()
+	var due []func()
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		due = due[:0]
+		for len(t.pending) > 0 && !t.pending[0].at.After(now) {
+			due = append(due, heap.Pop(&t.pending).(timer).fn)
+		}
+		wait := time.Duration(-1)
+		if len(t.pending) > 0 {
+			wait = t.pending[0].at.Sub(now)
+		}
+		t.mu.Unlock()
+
+		// callbacks run without the lock so they may schedule more
+		for _, fn := range due {
+			fn()
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		if wait < 0 {
+			<-t.wake
+			continue
+		}
+		clock.Reset(wait)
+		select {
+		case <-clock.C:
+		case <-t.wake:
+			clock.Stop()
+		}
+	}
+}
+
+// Close stops the timers once the running callbacks returned. With flush
+// the pending callbacks run right away in deadline order, otherwise they
+// are dropped. Returns how many were pending
+func (t *Timers) Close(flush bool) int {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	<-t.done
+
+	pending := len(t.pending)
+	for len(t.pending) > 0 {
+		fn := heap.Pop(&t.pending).(timer).fn
+		if flush {
+			fn()
+		}
+	}
+	return pending
+}
+
+// Pending returns how many callbacks wait and the most that ever waited
+func (t *Timers) Pending() (n, max int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending), t.maxLen
+}
@@ -0,0 +1,65 @@
+package netem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimersEqualDeadlinesRunInOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration // from now to the shared deadline
+		flush bool          // close with flush instead of waiting for the deadline
+	}{
+		{"past deadline", -time.Second, false},
+		{"future deadline", 20 * time.Millisecond, false},
+		{"flushed on close", time.Hour, true},
+	}
+
+	const n = 200
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timers := NewTimers()
+			ran := make(chan int, n)
+			at := time.Now().Add(tt.delay)
+			for i := 0; i < n; i++ {
+				if !timers.At(at, func() { ran <- i }) {
+					t.Fatalf("At refused timer %d", i)
+				}
+			}
+
+			if tt.flush {
+				if pending := timers.Close(true); pending != n {
+					t.Fatalf("Close reported %d pending, want %d", pending, n)
+				}
+			} else {
+				defer timers.Close(false)
+			}
+
+			for want := 0; want < n; want++ {
+				select {
+				case got := <-ran:
+					if got != want {
+						t.Fatalf("callback %d ran in position %d", got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d of %d callbacks ran", want, n)
+				}
+			}
+		})
+	}
+}
+
+func TestTimersEarlierDeadlineFirst(t *testing.T) {
+	timers := NewTimers()
+	ran := make(chan string, 2)
+	now := time.Now()
+	timers.At(now.Add(40*time.Millisecond), func() { ran <- "late" })
+	timers.At(now.Add(10*time.Millisecond), func() { ran <- "early" })
+	if pending := timers.Close(true); pending != 2 {
+		t.Fatalf("Close reported %d pending, want 2", pending)
+	}
+	if first, second := <-ran, <-ran; first != "early" || second != "late" {
+		t.Fatalf("ran %s then %s, want early then late", first, second)
+	}
+}
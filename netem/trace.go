@@ -0,0 +1,290 @@
+package netem
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-network-mini-project/config"
+)
+
+const (
+	outcomeDelivered = "delivered"
+	outcomeDropped   = "dropped"
+)
+
+// TraceEntry is one line of a trace. Replay only uses Outcome and DelayUs,
+// the other fields help reading a recorded trace
+type TraceEntry struct {
+	Index   int    `json:"index"`
+	Seq     uint32 `json:"seq"`
+	Type    string `json:"type"`
+	Outcome string `json:"outcome"` // delivered or dropped
+	DelayUs int64  `json:"delay_us"`
+}
+
+var traceCSVHeader = []string{"index", "seq", "type", "outcome", "delay_us"}
+
+// traceStep is a replayed outcome
+type traceStep struct {
+	drop  bool
+	delay time.Duration
+}
+
+// traceReplay hands out the outcomes of a trace file in order
+type traceReplay struct {
+	path  string
+	steps []traceStep
+	next  int
+	loop  bool
+}
+
+func isJSONL(path string) bool {
+	return strings.HasSuffix(path, ".jsonl")
+}
+
+func loadTrace(cfg config.TraceConfig) (*traceReplay, error) {
+	f, err := os.Open(cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var steps []traceStep
+	if isJSONL(cfg.Replay) {
+		steps, err = readTraceJSONL(f)
+	} else {
+		steps, err = readTraceCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace %s: %w", cfg.Replay, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("trace %s has no packets", cfg.Replay)
+	}
+	return &traceReplay{path: cfg.Replay, steps: steps, loop: cfg.Loop}, nil
+}
+
+func parseTraceStep(outcome string, delayUs int64) (traceStep, error) {
+	if delayUs < 0 {
+		return traceStep{}, fmt.Errorf("negative delay %d", delayUs)
+	}
+	switch outcome {
+	case outcomeDelivered:
+		return traceStep{delay: time.Duration(delayUs) * time.Microsecond}, nil
+	case outcomeDropped:
+		return traceStep{drop: true}, nil
+	default:
+		return traceStep{}, fmt.Errorf("unknown outcome %q", outcome)
+	}
+}
+
+func readTraceCSV(r io.Reader) ([]traceStep, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	outcomeCol, delayCol := -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "outcome":
+			outcomeCol = i
+		case "delay_us":
+			delayCol = i
+		}
+	}
+	if outcomeCol < 0 || delayCol < 0 {
+		return nil, fmt.Errorf("header needs outcome and delay_us columns")
+	}
+
+	var steps []traceStep
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return steps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) <= max(outcomeCol, delayCol) {
+			return nil, fmt.Errorf("line %d: missing columns", line)
+		}
+
+		delayUs, err := strconv.ParseInt(strings.TrimSpace(record[delayCol]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		step, err := parseTraceStep(strings.TrimSpace(record[outcomeCol]), delayUs)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+}
+
+func readTraceJSONL(r io.Reader) ([]traceStep, error) {
+	var steps []traceStep
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var entry TraceEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		step, err := parseTraceStep(entry.Outcome, entry.DelayUs)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
+
+// step returns the outcome of the next packet, ok is false once a trace
+// that does not loop has run out
+func (t *traceReplay) step() (traceStep, bool) {
+	if t.next >= len(t.steps) {
+		if !t.loop {
+			return traceStep{}, false
+		}
+		t.next = 0
+	}
+	s := t.steps[t.next]
+	t.next++
+	return s, true
+}
+
+func (t *traceReplay) String() string {
+	s := fmt.Sprintf("trace replay %s (%d packets", t.path, len(t.steps))
+	if t.loop {
+		s += ", looped"
+	}
+	return s + ")"
+}
+
+// TraceRecorder writes the outcome of every packet on a link to a trace
+// file that the replay mode can read back. An outcome may only be final
+// once the packet left the bottleneck queue, entries are still written in
+// the order the packets arrived
+type TraceRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	csv     *csv.Writer
+	index   int                // last index handed out
+	written int                // last index written
+	done    map[int]TraceEntry // finished entries waiting for earlier ones
+}
+
+// TracePending is a packet whose outcome is not decided yet
+type TracePending struct {
+	r     *TraceRecorder
+	entry TraceEntry
+}
+
+// NewTraceRecorder returns nil for an empty path
+func NewTraceRecorder(path string) (*TraceRecorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TraceRecorder{f: f, w: bufio.NewWriter(f), done: make(map[int]TraceEntry)}
+	if !isJSONL(path) {
+		r.csv = csv.NewWriter(r.w)
+		r.csv.Write(traceCSVHeader)
+	}
+	return r, r.flush()
+}
+
+// Start takes the next index for a packet, call it for exactly the packets
+// a replay would consume a step for. A nil recorder returns nil
+func (r *TraceRecorder) Start(seq uint32, packetType string) *TracePending {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.index++
+	return &TracePending{r: r, entry: TraceEntry{Index: r.index, Seq: seq, Type: packetType}}
+}
+
+// Finish records the final outcome of the packet. The file is flushed every
+// time so a killed proxy leaves a complete trace. Finishing a nil pending
+// does nothing
+func (p *TracePending) Finish(d Decision) error {
+	if p == nil {
+		return nil
+	}
+	entry := p.entry
+	entry.Outcome = outcomeDelivered
+	entry.DelayUs = d.Delay.Microseconds()
+	if d.Drop {
+		entry.Outcome = outcomeDropped
+		entry.DelayUs = 0
+	}
+
+	r := p.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done[entry.Index] = entry
+	for {
+		next, ok := r.done[r.written+1]
+		if !ok {
+			break
+		}
+		delete(r.done, next.Index)
+		r.written++
+		if err := r.write(next); err != nil {
+			return err
+		}
+	}
+	return r.flush()
+}
+
+// write appends one entry, caller holds r.mu
+func (r *TraceRecorder) write(entry TraceEntry) error {
+	if r.csv != nil {
+		return r.csv.Write([]string{strconv.Itoa(entry.Index), strconv.FormatUint(uint64(entry.Seq), 10),
+			entry.Type, entry.Outcome, strconv.FormatInt(entry.DelayUs, 10)})
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(line, '\n'))
+	return err
+}
+
+func (r *TraceRecorder) flush() error {
+	if r.csv != nil {
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return r.w.Flush()
+}
+
+func (r *TraceRecorder) Path() string {
+	return r.f.Name()
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ack payload layout: ce_count(4)
+const ackSize = 4
+
+var ErrBadAck = errors.New("malformed ACK payload")
+
+// ParseAckCE returns the CE count echoed in an ACK
+func ParseAckCE(p *Packet) (uint32, error) {
+	if p.Type != TypeAck || len(p.Payload) < ackSize {
+		return 0, ErrBadAck
+	}
+	return binary.BigEndian.Uint32(p.Payload[0:4]), nil
+}
+
+// MarkCE sets FlagCE on an encoded datagram in place. The checksum is only
+// rewritten if it was valid, so a corrupted packet stays detectable
+func MarkCE(buf []byte) error {
+	h, err := ParseHeader(buf)
+	if err != nil {
+		return err
+	}
+	valid := len(buf) == HeaderSize+int(h.PayloadLen) && binary.BigEndian.Uint32(buf[28:32]) == checksum(buf)
+
+	buf[4] |= uint8(FlagCE)
+	if valid {
+		binary.BigEndian.PutUint32(buf[28:32], checksum(buf))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Unbounded as TotalPackets means the server sends until it is stopped
+const Unbounded uint32 = 0
+
+// hello payload layout: version(1) reserved(1) payload_size(2) total_packets(4)
+const helloSize = 8
+
+var ErrBadHello = errors.New("malformed HELLO payload")
+
+// Hello carries the stream parameters the server announces before sending
+// data, clients size their reorder buffer from it
+type Hello struct {
+	Version      uint8
+	PayloadSize  uint16
+	TotalPackets uint32
+}
+
+// NewHello builds a HELLO for the session, Version is filled in if unset
+func NewHello(sessionID uint32, hello Hello) *Packet {
+	if hello.Version == 0 {
+		hello.Version = Version
+	}
+
+	payload := make([]byte, helloSize)
+	payload[0] = hello.Version
+	binary.BigEndian.PutUint16(payload[2:4], hello.PayloadSize)
+	binary.BigEndian.PutUint32(payload[4:8], hello.TotalPackets)
+
+	return &Packet{
+		Header: Header{
+			Type:      TypeHello,
+			SessionID: sessionID,
+			Timestamp: time.Now().UnixNano(),
+		},
+		Payload: payload,
+	}
+}
+
+// ParseHello decodes the payload of a HELLO packet
+func ParseHello(p *Packet) (Hello, error) {
+	if p.Type != TypeHello || len(p.Payload) < helloSize {
+		return Hello{}, ErrBadHello
+	}
+
+	return Hello{
+		Version:      p.Payload[0],
+		PayloadSize:  binary.BigEndian.Uint16(p.Payload[2:4]),
+		TotalPackets: binary.BigEndian.Uint32(p.Payload[4:8]),
+	}, nil
+}
+
+// NewHelloAck confirms a HELLO for the session
+func NewHelloAck(sessionID uint32, clientID uint32) *Packet {
+	return &Packet{Header: Header{
+		Type:      TypeHelloAck,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Timestamp: time.Now().UnixNano(),
+	}}
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxNACKRanges bounds one NACK datagram, longer loss lists are split
+const MaxNACKRanges = 128
+
+// nack payload layout: count(2) then count x [first(4) last(4)],
+// the header Seq holds the base (first missing sequence number)
+const nackRangeSize = 8
+
+var ErrBadNACK = errors.New("malformed NACK payload")
+
+// SeqRange is an inclusive range of missing sequence numbers
+type SeqRange struct {
+	First uint32
+	Last  uint32
+}
+
+func (r SeqRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%d", r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// Len returns how many sequence numbers the range covers
+func (r SeqRange) Len() int {
+	return int(r.Last-r.First) + 1
+}
+
+// Ranges coalesces sequence numbers into sorted inclusive ranges
+func Ranges(seqs []int) []SeqRange {
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	sorted := append([]int(nil), seqs...)
+	sort.Ints(sorted)
+
+	var ranges []SeqRange
+	cur := SeqRange{First: uint32(sorted[0]), Last: uint32(sorted[0])}
+	for _, seq := range sorted[1:] {
+		switch {
+		case uint32(seq) == cur.Last:
+			// duplicate
+		case uint32(seq) == cur.Last+1:
+			cur.Last++
+		default:
+			ranges = append(ranges, cur)
+			cur = SeqRange{First: uint32(seq), Last: uint32(seq)}
+		}
+	}
+	return append(ranges, cur)
+}
+
+// NewNACKs builds selective NACKs for the given ranges, splitting them into
+// as many datagrams as MaxNACKRanges requires
+func NewNACKs(sessionID uint32, clientID uint32, ranges []SeqRange) []*Packet {
+	var packets []*Packet
+	for len(ranges) > 0 {
+		n := min(len(ranges), MaxNACKRanges)
+		packets = append(packets, newNACK(sessionID, clientID, ranges[:n]))
+		ranges = ranges[n:]
+	}
+	return packets
+}
+
+func newNACK(sessionID uint32, clientID uint32, ranges []SeqRange) *Packet {
+	payload := make([]byte, 2+len(ranges)*nackRangeSize)
+	binary.BigEndian.PutUint16(payload[0:2], uint16(len(ranges)))
+	for i, r := range ranges {
+		off := 2 + i*nackRangeSize
+		binary.BigEndian.PutUint32(payload[off:off+4], r.First)
+		binary.BigEndian.PutUint32(payload[off+4:off+8], r.Last)
+	}
+
+	return &Packet{
+		Header: Header{
+			Type:      TypeNACK,
+			SessionID: sessionID,
+			ClientID:  clientID,
+			Seq:       ranges[0].First,
+			Timestamp: time.Now().UnixNano(),
+		},
+		Payload: payload,
+	}
+}
+
+// ParseNACK decodes the missing ranges of a NACK packet
+func ParseNACK(p *Packet) ([]SeqRange, error) {
+	if p.Type != TypeNACK || len(p.Payload) < 2 {
+		return nil, ErrBadNACK
+	}
+
+	count := int(binary.BigEndian.Uint16(p.Payload[0:2]))
+	if count == 0 || len(p.Payload) != 2+count*nackRangeSize {
+		return nil, ErrBadNACK
+	}
+
+	ranges := make([]SeqRange, count)
+	for i := range ranges {
+		off := 2 + i*nackRangeSize
+		ranges[i] = SeqRange{
+			First: binary.BigEndian.Uint32(p.Payload[off : off+4]),
+			Last:  binary.BigEndian.Uint32(p.Payload[off+4 : off+8]),
+		}
+		if ranges[i].First > ranges[i].Last {
+			return nil, ErrBadNACK
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// wire layout (big endian):
+//
+//	magic(2) version(1) type(1) flags(1) reserved(1)
+//	session_id(4) client_id(4) seq(4) timestamp(8) payload_len(2) checksum(4)
+//
+// checksum is CRC32C over the whole datagram with the checksum field zeroed
+const (
+	Magic      uint16 = 0x5350 // "SP"
+	Version    uint8  = 3
+	HeaderSize        = 32
+
+	// MaxPacketSize is large enough for any UDP datagram, use it for read buffers
+	MaxPacketSize = 65535
+
+	// MaxPayloadSize keeps a packet within the largest IPv4 UDP payload
+	MaxPayloadSize = 65507 - HeaderSize
+)
+
+var (
+	ErrShortPacket = errors.New("packet shorter than header")
+	ErrBadMagic    = errors.New("bad magic")
+	ErrBadVersion  = errors.New("unsupported protocol version")
+	ErrBadLength   = errors.New("payload length does not match datagram size")
+	ErrBadChecksum = errors.New("checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Type uint8
+
+const (
+	TypeData Type = 1
+	TypeNACK Type = 2
+	TypeFIN  Type = 3
+
+	TypeHello    Type = 4
+	TypeHelloAck Type = 5
+	TypeAck      Type = 6
+	TypeFinAck   Type = 7
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeData:
+		return "DATA"
+	case TypeNACK:
+		return "NACK"
+	case TypeFIN:
+		return "FIN"
+	case TypeHello:
+		return "HELLO"
+	case TypeHelloAck:
+		return "HELLO-ACK"
+	case TypeAck:
+		return "ACK"
+	case TypeFinAck:
+		return "FIN-ACK"
+	default:
+		return fmt.Sprintf("TYPE(%d)", uint8(t))
+	}
+}
+
+// FromReceiver reports whether clients send this type back to the server
+func (t Type) FromReceiver() bool {
+	switch t {
+	case TypeNACK, TypeFIN, TypeHelloAck, TypeAck:
+		return true
+	default:
+		return false
+	}
+}
+
+type Flags uint8
+
+const (
+	// FlagRetransmit is set by the server when a packet is resent after a NACK
+	FlagRetransmit Flags = 1 << 0
+	// FlagCE (congestion experienced) is set on data packets by a proxy
+	// whose queue is building up
+	FlagCE Flags = 1 << 1
+)
+
+type Header struct {
+	Type      Type
+	Flags     Flags
+	SessionID uint32
+	// ClientID identifies the receiver independent of the path it uses,
+	// set on everything a client sends and on retransmissions, 0 on data
+	// sent to all clients
+	ClientID   uint32
+	Seq        uint32
+	Timestamp  int64 // send time in UnixNano
+	PayloadLen uint16
+}
+
+type Packet struct {
+	Header
+	Payload []byte
+}
+
+// SendTime returns the header timestamp as time.Time
+func (h Header) SendTime() time.Time {
+	return time.Unix(0, h.Timestamp)
+}
+
+func (h Header) String() string {
+	s := fmt.Sprintf("%s seq=%d session=%08x", h.Type, h.Seq, h.SessionID)
+	if h.ClientID != 0 {
+		s += fmt.Sprintf(" client=%d", h.ClientID)
+	}
+	if h.Flags&FlagRetransmit != 0 {
+		s += " (retransmit)"
+	}
+	if h.Flags&FlagCE != 0 {
+		s += " (CE)"
+	}
+	return s
+}
+
+// Marshal encodes the packet, PayloadLen is taken from the payload
+func (p *Packet) Marshal() []byte {
+	buf := make([]byte, HeaderSize+len(p.Payload))
+	binary.BigEndian.PutUint16(buf[0:2], Magic)
+	buf[2] = Version
+	buf[3] = uint8(p.Type)
+	buf[4] = uint8(p.Flags)
+	buf[5] = 0
+	binary.BigEndian.PutUint32(buf[6:10], p.SessionID)
+	binary.BigEndian.PutUint32(buf[10:14], p.ClientID)
+	binary.BigEndian.PutUint32(buf[14:18], p.Seq)
+	binary.BigEndian.PutUint64(buf[18:26], uint64(p.Timestamp))
+	binary.BigEndian.PutUint16(buf[26:28], uint16(len(p.Payload)))
+	copy(buf[HeaderSize:], p.Payload)
+	binary.BigEndian.PutUint32(buf[28:32], checksum(buf))
+	return buf
+}
+
+// Unmarshal decodes a datagram and verifies its checksum, the payload is
+// copied so buf can be reused
+func Unmarshal(buf []byte) (*Packet, error) {
+	h, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != HeaderSize+int(h.PayloadLen) {
+		return nil, ErrBadLength
+	}
+	if binary.BigEndian.Uint32(buf[28:32]) != checksum(buf) {
+		return nil, ErrBadChecksum
+	}
+
+	payload := make([]byte, h.PayloadLen)
+	copy(payload, buf[HeaderSize:])
+	return &Packet{Header: h, Payload: payload}, nil
+}
+
+// ParseHeader decodes only the fixed header without checking the checksum,
+// used by proxies for routing
+func ParseHeader(buf []byte) (Header, error) {
+	if len(buf) < HeaderSize {
+		return Header{}, ErrShortPacket
+	}
+	if binary.BigEndian.Uint16(buf[0:2]) != Magic {
+		return Header{}, ErrBadMagic
+	}
+	if buf[2] != Version {
+		return Header{}, ErrBadVersion
+	}
+
+	return Header{
+		Type:       Type(buf[3]),
+		Flags:      Flags(buf[4]),
+		SessionID:  binary.BigEndian.Uint32(buf[6:10]),
+		ClientID:   binary.BigEndian.Uint32(buf[10:14]),
+		Seq:        binary.BigEndian.Uint32(buf[14:18]),
+		Timestamp:  int64(binary.BigEndian.Uint64(buf[18:26])),
+		PayloadLen: binary.BigEndian.Uint16(buf[26:28]),
+	}, nil
+}
+
+func checksum(buf []byte) uint32 {
+	var zero [4]byte
+	crc := crc32.Update(0, crcTable, buf[:28])
+	crc = crc32.Update(crc, crcTable, zero[:])
+	return crc32.Update(crc, crcTable, buf[HeaderSize:])
+}
+
+// NewAck builds a cumulative ACK: every packet below seq has been received.
+// ceCount echoes how many CE marked data packets the client has seen so far
+func NewAck(sessionID uint32, clientID uint32, seq uint32, ceCount uint32) *Packet {
+	payload := make([]byte, ackSize)
+	binary.BigEndian.PutUint32(payload, ceCount)
+
+	return &Packet{
+		Header: Header{
+			Type:      TypeAck,
+			SessionID: sessionID,
+			ClientID:  clientID,
+			Seq:       seq,
+			Timestamp: time.Now().UnixNano(),
+		},
+		Payload: payload,
+	}
+}
+
+// NewFIN builds a FIN telling the server the client is done
+func NewFIN(sessionID uint32, clientID uint32) *Packet {
+	return &Packet{Header: Header{
+		Type:      TypeFIN,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Timestamp: time.Now().UnixNano(),
+	}}
+}
+
+// NewFinAck confirms a FIN, the client stops retransmitting its FIN
+func NewFinAck(sessionID uint32, clientID uint32) *Packet {
+	return &Packet{Header: Header{
+		Type:      TypeFinAck,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Timestamp: time.Now().UnixNano(),
+	}}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"go-network-mini-project/config"
+	"go-network-mini-project/netem"
+)
+
+// controlServer is the runtime control API of the proxy, a small HTTP
+// server on a local address. Bodies are YAML, JSON works too
+//
+//	GET   /status                    settings and counters of both links and the flows
+//	GET   /links/{dir}               impairment of forward or reverse
+//	PATCH /links/{dir}               change the given impairment fields
+//	PUT   /links/{dir}               replace the whole impairment
+//	POST  /links/{dir}/blackout?for= drop everything for a while (e.g. for=3s)
+//	POST  /links/{dir}/pause         drop everything until resume
+//	POST  /links/{dir}/resume
+//	GET   /rules                     fault injection rules with their hit counts
+//	PUT   /rules                     replace all rules, a YAML list
+//	POST  /rules                     add one rule
+//
+// An update is applied as a whole or not at all. A running schedule
+// overrides it at its next phase
+type controlServer struct {
+	seed      int64
+	links     map[string]*link // by direction, forward and reverse
+	flows     *flowTable
+	rules     *netem.Rules
+	quietMode bool
+}
+
+type linkStatus struct {
+	Name         string             `yaml:"name"`
+	Impairment   string             `yaml:"impairment"` // summary, GET /links/{dir} has the settings
+	Paused       bool               `yaml:"paused"`
+	BlackoutLeft time.Duration      `yaml:"blackout_left,omitempty"`
+	Stats        netem.Counts       `yaml:"stats"`
+	Queue        *netem.QueueCounts `yaml:"queue,omitempty"`
+}
+
+type flowStatus struct {
+	Server   string        `yaml:"server"`
+	Client   string        `yaml:"client"`
+	Session  string        `yaml:"session"`
+	ToClient int           `yaml:"to_client"`
+	ToServer int           `yaml:"to_server"`
+	Idle     time.Duration `yaml:"idle"`
+}
+
+type proxyStatus struct {
+	Seed    int64              `yaml:"seed"`
+	Forward linkStatus         `yaml:"forward"`
+	Reverse linkStatus         `yaml:"reverse"`
+	Rules   []netem.RuleStatus `yaml:"rules"`
+	Flows   []flowStatus       `yaml:"flows"`
+}
+
+func (c *controlServer) listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("GET /links/{dir}", c.handleGetLink)
+	mux.HandleFunc("PATCH /links/{dir}", c.handleUpdateLink)
+	mux.HandleFunc("PUT /links/{dir}", c.handleUpdateLink)
+	mux.HandleFunc("POST /links/{dir}/blackout", c.handleBlackout)
+	mux.HandleFunc("POST /links/{dir}/pause", c.handlePause)
+	mux.HandleFunc("POST /links/{dir}/resume", c.handlePause)
+	mux.HandleFunc("GET /rules", c.handleGetRules)
+	mux.HandleFunc("PUT /rules", c.handleUpdateRules)
+	mux.HandleFunc("POST /rules", c.handleUpdateRules)
+
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func (l *link) status() linkStatus {
+	s := linkStatus{Name: l.name, Impairment: l.String()}
+
+	l.mu.Lock()
+	s.Paused = l.paused
+	if left := time.Until(l.blackoutUntil); left > 0 {
+		s.BlackoutLeft = left.Round(time.Millisecond)
+	}
+	bottleneck := l.bottleneck
+	l.mu.Unlock()
+
+	s.Stats = l.stats.Snapshot()
+	if bottleneck != nil {
+		queue := bottleneck.Snapshot()
+		s.Queue = &queue
+	}
+	return s
+}
+
+func (l *link) settings() config.ImpairmentConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+func writeYAML(w http.ResponseWriter, v any) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+func (c *controlServer) link(w http.ResponseWriter, r *http.Request) *link {
+	l, ok := c.links[r.PathValue("dir")]
+	if !ok {
+		http.Error(w, "direction must be forward or reverse", http.StatusNotFound)
+		return nil
+	}
+	return l
+}
+
+// logf reports a change made through the API
+func (c *controlServer) logf(format string, args ...any) {
+	if !c.quietMode {
+		fmt.Printf("%s %s control: %s\n", tag, time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+	}
+}
+
+func (c *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := proxyStatus{
+		Seed:    c.seed,
+		Forward: c.links["forward"].status(),
+		Reverse: c.links["reverse"].status(),
+		Rules:   c.rules.Status(),
+	}
+	for _, f := range c.flows.snapshot() {
+		status.Flows = append(status.Flows, flowStatus{
+			Server:   f.server.String(),
+			Client:   f.client.String(),
+			Session:  fmt.Sprintf("%08x", f.sessionID),
+			ToClient: f.toClient,
+			ToServer: f.toServer,
+			Idle:     time.Since(f.lastSeen).Round(time.Millisecond),
+		})
+	}
+	writeYAML(w, status)
+}
+
+func (c *controlServer) handleGetLink(w http.ResponseWriter, r *http.Request) {
+	if l := c.link(w, r); l != nil {
+		writeYAML(w, l.settings())
+	}
+}
+
+// handleUpdateLink decodes the body over the current impairment for PATCH
+// and over an empty one for PUT
+func (c *controlServer) handleUpdateLink(w http.ResponseWriter, r *http.Request) {
+	l := c.link(w, r)
+	if l == nil {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cfg config.ImpairmentConfig
+	if r.Method == http.MethodPatch {
+		cfg = l.settings()
+		if cfg.GilbertElliott != nil {
+			// decode into a copy, the link keeps pointing at the old one
+			ge := *cfg.GilbertElliott
+			cfg.GilbertElliott = &ge
+		}
+	}
+	if err := yaml.UnmarshalStrict(body, &cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := l.configure(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.logf("%s now %s", l.name, l)
+	writeYAML(w, l.settings())
+}
+
+func (c *controlServer) handleBlackout(w http.ResponseWriter, r *http.Request) {
+	l := c.link(w, r)
+	if l == nil {
+		return
+	}
+	d, err := time.ParseDuration(r.URL.Query().Get("for"))
+	if err != nil || d <= 0 {
+		http.Error(w, "blackout needs a positive duration, e.g. ?for=3s", http.StatusBadRequest)
+		return
+	}
+
+	l.mu.Lock()
+	l.blackoutUntil = time.Now().Add(d)
+	l.mu.Unlock()
+
+	c.logf("%s blackout for %v", l.name, d)
+	writeYAML(w, l.status())
+}
+
+func (c *controlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	l := c.link(w, r)
+	if l == nil {
+		return
+	}
+	paused := strings.HasSuffix(r.URL.Path, "/pause")
+
+	l.mu.Lock()
+	l.paused = paused
+	if !paused {
+		l.blackoutUntil = time.Time{}
+	}
+	l.mu.Unlock()
+
+	if paused {
+		c.logf("%s paused", l.name)
+	} else {
+		c.logf("%s resumed", l.name)
+	}
+	writeYAML(w, l.status())
+}
+
+func (c *controlServer) handleGetRules(w http.ResponseWriter, r *http.Request) {
+	writeYAML(w, c.rules.Status())
+}
+
+// handleUpdateRules replaces the rules with a list for PUT and adds a single
+// rule for POST
+func (c *controlServer) handleUpdateRules(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var rules []config.RuleConfig
+		if err = yaml.UnmarshalStrict(body, &rules); err == nil {
+			err = c.rules.Replace(rules)
+		}
+	} else {
+		var rule config.RuleConfig
+		if err = yaml.UnmarshalStrict(body, &rule); err == nil {
+			err = c.rules.Add(rule)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.logf("rules now %s", c.rules)
+	writeYAML(w, c.rules.Status())
+}
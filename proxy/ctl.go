@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const ctlUsage = `usage: proxy [-name proxy1] ctl [-addr host:port] <command>
+  status                       settings and counters of both links and the flows
+  get <forward|reverse>        impairment of one direction
+  set <forward|reverse> <yaml> change fields, e.g. set forward '{loss_rate: 0.3}'
+  replace <forward|reverse> <yaml>
+                               replace the whole impairment ('{}' forwards untouched)
+  blackout <forward|reverse> <duration>
+  pause <forward|reverse>
+  resume <forward|reverse>
+  rules                        fault injection rules and their hits
+  rules add <yaml>             add a rule, e.g. rules add '{type: FIN, action: drop}'
+  rules replace <yaml list>    replace all rules ('[]' removes them)`
+
+// runCtl is the ctl subcommand, it talks to the control API of a running proxy
+func runCtl(defaultAddr string, args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	addr := flags.String("addr", defaultAddr, "control address of the proxy")
+	flags.Usage = func() { fmt.Fprintln(flags.Output(), ctlUsage) }
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" {
+		return errors.New("no control address, set the proxy's control address in config.yaml or pass -addr")
+	}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+	base := "http://" + *addr
+
+	var method, path, body string
+	switch cmd := args[0]; {
+	case cmd == "status" && len(args) == 1:
+		method, path = http.MethodGet, "/status"
+	case cmd == "get" && len(args) == 2:
+		method, path = http.MethodGet, "/links/"+args[1]
+	case cmd == "set" && len(args) == 3:
+		method, path, body = http.MethodPatch, "/links/"+args[1], args[2]
+	case cmd == "replace" && len(args) == 3:
+		method, path, body = http.MethodPut, "/links/"+args[1], args[2]
+	case cmd == "blackout" && len(args) == 3:
+		if _, err := time.ParseDuration(args[2]); err != nil {
+			return err
+		}
+		method, path = http.MethodPost, "/links/"+args[1]+"/blackout?for="+url.QueryEscape(args[2])
+	case (cmd == "pause" || cmd == "resume") && len(args) == 2:
+		method, path = http.MethodPost, "/links/"+args[1]+"/"+cmd
+	case cmd == "rules" && len(args) == 1:
+		method, path = http.MethodGet, "/rules"
+	case cmd == "rules" && len(args) == 3 && args[1] == "add":
+		method, path, body = http.MethodPost, "/rules", args[2]
+	case cmd == "rules" && len(args) == 3 && args[1] == "replace":
+		method, path, body = http.MethodPut, "/rules", args[2]
+	default:
+		flags.Usage()
+		return fmt.Errorf("bad command %q", strings.Join(args, " "))
+	}
+
+	req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	os.Stdout.Write(out)
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go-network-mini-project/protocol"
+)
+
+const (
+	defaultFlowIdleTimeout = 30 * time.Second
+	// a new server's HELLO takes over a flow whose server sent nothing for
+	// this long, e.g. after the server was killed mid-run
+	serverQuietTimeout = 3 * time.Second
+)
+
+var (
+	errNotHello        = errors.New("unknown server and not a HELLO")
+	errNoFreeClient    = errors.New("every client is busy with another flow")
+	errUnknownClient   = errors.New("client has no active flow")
+	errSessionMismatch = errors.New("session does not match the client's flow")
+)
+
+// flow is one transfer relayed by the proxy, from a server to a client
+type flow struct {
+	server     *net.UDPAddr
+	client     *net.UDPAddr
+	sessionID  uint32
+	started    time.Time
+	lastSeen   time.Time
+	serverSeen time.Time // last packet from the server, the client's own traffic does not count
+	toClient   int
+	toServer   int
+	finished   bool // the server sent the FIN-ACK, the client may be taken over
+}
+
+func (f *flow) String() string {
+	return fmt.Sprintf("%s -> %s session %08x", f.server, f.client, f.sessionID)
+}
+
+// flowTable maps servers to the clients they talk to. A flow starts with a
+// server's HELLO and takes the first client that has no flow, else one whose
+// flow finished or whose server went quiet for serverQuietTimeout, so several
+// transfers can share the proxy and a restarted server gets its client back
+// within a few seconds instead of waiting for the old flow to expire. Stray
+// datagrams cannot redirect a flow: a client's packets only go back to the
+// server of its own session. Flows without traffic in either direction
+// expire after idleTimeout
+type flowTable struct {
+	mu          sync.Mutex
+	clients     []*net.UDPAddr
+	idleTimeout time.Duration
+	byServer    map[string]*flow
+	byClient    map[string]*flow
+}
+
+func newFlowTable(clients []*net.UDPAddr, idleTimeout time.Duration) *flowTable {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultFlowIdleTimeout
+	}
+	return &flowTable{
+		clients:     clients,
+		idleTimeout: idleTimeout,
+		byServer:    make(map[string]*flow),
+		byClient:    make(map[string]*flow),
+	}
+}
+
+// isClient reports whether addr is one of the clients the proxy relays to
+func (t *flowTable) isClient(addr *net.UDPAddr) bool {
+	for _, client := range t.clients {
+		if client.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// fromServer returns the flow of a packet from a server, a HELLO from an
+// unknown server opens a new one. created is set for new flows
+func (t *flowTable) fromServer(addr *net.UDPAddr, header protocol.Header) (f *flow, created bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if f, ok := t.byServer[addr.String()]; ok {
+		if header.Type == protocol.TypeHello && header.SessionID != f.sessionID {
+			// the server started a new session on the same socket
+			f.sessionID = header.SessionID
+			f.started = now
+			f.finished = false
+		}
+		if header.Type == protocol.TypeFinAck && header.SessionID == f.sessionID {
+			f.finished = true
+		}
+		f.lastSeen = now
+		f.serverSeen = now
+		f.toClient++
+		return f, false, nil
+	}
+
+	if header.Type != protocol.TypeHello {
+		return nil, false, errNotHello
+	}
+	client := t.freeClient(now)
+	if client == nil {
+		return nil, false, errNoFreeClient
+	}
+	if old, ok := t.byClient[client.String()]; ok {
+		// the old transfer is over or its server is gone, its flow gives up the client
+		delete(t.byServer, old.server.String())
+	}
+	f = &flow{server: addr, client: client, sessionID: header.SessionID, started: now, lastSeen: now, serverSeen: now, toClient: 1}
+	t.byServer[addr.String()] = f
+	t.byClient[client.String()] = f
+	return f, true, nil
+}
+
+// freeClient picks a client without a flow, else one whose flow finished
+// or whose server went quiet. Caller holds t.mu
+func (t *flowTable) freeClient(now time.Time) *net.UDPAddr {
+	var abandoned *net.UDPAddr
+	for _, client := range t.clients {
+		f, busy := t.byClient[client.String()]
+		if !busy {
+			return client
+		}
+		if abandoned == nil && (f.finished || now.Sub(f.serverSeen) > serverQuietTimeout) {
+			abandoned = client
+		}
+	}
+	return abandoned
+}
+
+// fromClient returns the flow a client's packet belongs to
+func (t *flowTable) fromClient(addr *net.UDPAddr, header protocol.Header) (*flow, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.byClient[addr.String()]
+	if !ok {
+		return nil, errUnknownClient
+	}
+	if header.SessionID != f.sessionID {
+		return nil, errSessionMismatch
+	}
+	f.lastSeen = time.Now()
+	f.toServer++
+	return f, nil
+}
+
+// expire removes flows idle for longer than the timeout and returns them
+func (t *flowTable) expire(now time.Time) []*flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var expired []*flow
+	for key, f := range t.byServer {
+		if now.Sub(f.lastSeen) > t.idleTimeout {
+			delete(t.byServer, key)
+			delete(t.byClient, f.client.String())
+			expired = append(expired, f)
+		}
+	}
+	return expired
+}
+
+// snapshot lists the active flows by start time
+func (t *flowTable) snapshot() []flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flows := make([]flow, 0, len(t.byServer))
+	for _, f := range t.byServer {
+		flows = append(flows, *f)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].started.Before(flows[j].started) })
+	return flows
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go-network-mini-project/capture"
+	"go-network-mini-project/config"
+	"go-network-mini-project/netem"
+	"go-network-mini-project/protocol"
+)
+
+// reverseSeedMix derives the reverse link's seed, each direction draws from
+// its own stream so control traffic cannot shift the data drop pattern
+const reverseSeedMix = 0x5851f42d4c957f2d
+
+// queueSeedMix derives the seed of a link's queue discipline. RED draws
+// only while its queue is building up, which depends on timing, so it must
+// not share the stream the impairment draws from
+const queueSeedMix = 0x14057b7ef767814f
+
+// tag prefixes the log lines, e.g. [Proxy1] for the proxy named proxy1
+var tag = "[Proxy]"
+
+// link is one direction through the proxy, each has its own impairment and counters
+type link struct {
+	dir      string // forward or reverse, as rules and the control API name it
+	name     string
+	rng      *rand.Rand           // impairment decisions
+	queueRNG *rand.Rand           // the bottleneck's queue discipline
+	schedule *netem.Schedule      // nil without a schedule
+	recorder *netem.TraceRecorder // nil unless trace.record is set
+	capture  *capture.Writer      // shared by both links, nil without a capture
+	timers   *netem.Timers        // releases delayed packets, shared by both links
+	rules    *netem.Rules         // shared by both links, each rule names its direction
+
+	mu            sync.Mutex // guards the fields below, the schedule and the control API change them
+	cfg           config.ImpairmentConfig
+	impairment    netem.Chain
+	bottleneck    *netem.Bottleneck // nil when the link has no rate limit
+	paused        bool              // drop everything until resumed
+	blackoutUntil time.Time         // drop everything until then
+	stats         netem.Stats
+}
+
+func newLink(dir, name string, cfg config.ImpairmentConfig, schedule config.ScheduleConfig, seed int64, timers *netem.Timers, rules *netem.Rules) (*link, error) {
+	l := &link{
+		dir:      dir,
+		name:     name,
+		rng:      rand.New(rand.NewSource(seed)),
+		queueRNG: rand.New(rand.NewSource(seed ^ queueSeedMix)),
+		timers:   timers,
+		rules:    rules,
+	}
+	if err := l.configure(cfg); err != nil {
+		return nil, err
+	}
+
+	var err error
+	l.schedule, err = netem.NewSchedule(schedule, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("schedule: %w", err)
+	}
+	l.recorder, err = netem.NewTraceRecorder(cfg.Trace.Record)
+	if err != nil {
+		return nil, fmt.Errorf("trace record: %w", err)
+	}
+	return l, nil
+}
+
+// configure replaces the impairment of the link, packets already waiting in
+// the bottleneck queue stay there
+func (l *link) configure(cfg config.ImpairmentConfig) error {
+	impairment, err := netem.New(cfg, l.rng)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.bottleneck != nil {
+		err = l.bottleneck.Update(cfg.Bandwidth)
+	} else {
+		l.bottleneck, err = netem.NewBottleneck(cfg.Bandwidth, l.queueRNG)
+	}
+	if err != nil {
+		return err
+	}
+	l.cfg = cfg
+	l.impairment = impairment
+	return nil
+}
+
+// current returns the impairment and bottleneck in effect
+func (l *link) current() (netem.Chain, *netem.Bottleneck) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.impairment, l.bottleneck
+}
+
+// decide draws the fate of the next packet, a paused or blacked out link
+// drops it. Rules apply to every packet, the random impairment only when
+// impair is set. Impaired packets are the ones a trace replay consumes a
+// step for, they get a pending trace entry that send finishes
+func (l *link) decide(header protocol.Header, frame int, impair bool, quietMode bool) (netem.Decision, *netem.TracePending) {
+	l.mu.Lock()
+	var decision netem.Decision
+	if impair {
+		// drawn even while paused so a replay stays in step
+		decision = l.impairment.Next()
+	}
+	if l.paused || time.Now().Before(l.blackoutUntil) {
+		decision = netem.Decision{Drop: true}
+	}
+	l.mu.Unlock()
+
+	fired := l.rules.Apply(l.dir, header, &decision)
+	for _, rule := range fired {
+		l.annotate(frame, "rule", rule)
+		if !quietMode {
+			fmt.Printf("%s %s RULE %s on %s\n", tag, l.name, rule, header)
+		}
+	}
+	if !impair && len(fired) == 0 {
+		return decision, nil
+	}
+
+	l.stats.Record(decision)
+	if !impair {
+		return decision, nil
+	}
+	return decision, l.recorder.Start(header.Seq, header.Type.String())
+}
+
+// traced records the final outcome of a packet, dropped is set when the
+// bottleneck dropped it after the decision
+func (l *link) traced(p packet, decision netem.Decision, dropped bool) {
+	if dropped {
+		decision = netem.Decision{Drop: true}
+	}
+	if err := p.trace.Finish(decision); err != nil {
+		fmt.Printf("%s %s trace record failed: %v\n", tag, l.name, err)
+	}
+}
+
+// runSchedule steps the link through its phases, logging every transition
+func (l *link) runSchedule(quietMode bool) {
+	l.schedule.Run(func(phase netem.Phase) {
+		if err := l.configure(phase.Impairment); err != nil {
+			fmt.Printf("%s %s %s %s: %v\n", tag, time.Now().Format("15:04:05.000"), l.name, phase, err)
+			return
+		}
+		if !quietMode {
+			fmt.Printf("%s %s %s %s: %s\n", tag, time.Now().Format("15:04:05.000"), l.name, phase, l)
+		}
+	})
+}
+
+func (l *link) printStats() {
+	counts := l.stats.Snapshot()
+	fmt.Printf("%s %s stats: %s\n", tag, l.name, counts)
+	fmt.Printf("%s %s %s\n", tag, l.name, counts.BurstString())
+	if _, bottleneck := l.current(); bottleneck != nil {
+		fmt.Printf("%s %s %s\n", tag, l.name, bottleneck.Snapshot())
+	}
+}
+
+func (l *link) String() string {
+	impairment, bottleneck := l.current()
+	if bottleneck == nil {
+		return impairment.String()
+	}
+	return impairment.String() + ", " + bottleneck.String()
+}
+
+// packet is one datagram on its way through a link
+type packet struct {
+	data  []byte
+	dst   *net.UDPAddr
+	what  string              // names the packet in log lines
+	ect   bool                // data packets may be CE marked by the bottleneck
+	frame int                 // capture frame the packet arrived in, 0 without a capture
+	trace *netem.TracePending // nil unless the link records a trace
+}
+
+// annotate records what happened to a captured packet in the sidecar
+func (l *link) annotate(frame int, event, detail string) {
+	if l.capture == nil || frame == 0 {
+		return
+	}
+	if err := l.capture.Annotate(frame, time.Now(), event, l.name, detail); err != nil {
+		fmt.Printf("%s %s capture annotate failed: %v\n", tag, l.name, err)
+	}
+}
+
+// send applies the impairment decision to one datagram and forwards it.
+// With a bottleneck the packet waits in its queue first, delayed packets are
+// released by the timers
+func (l *link) send(conn *net.UDPConn, p packet, decision netem.Decision, quietMode bool) {
+	_, bottleneck := l.current()
+	if decision.Drop {
+		l.traced(p, decision, true)
+		l.annotate(p.frame, "dropped", "impairment")
+		if !quietMode {
+			fmt.Printf("%s %s DROPPED %s - %s\n", tag, l.name, p.what, l.stats.Snapshot())
+		}
+		return
+	}
+	p.data = decision.Mutate(p.data)
+	if decision.Corrupt {
+		l.annotate(p.frame, "corrupted", "")
+		if !quietMode {
+			fmt.Printf("%s %s CORRUPTED %s\n", tag, l.name, p.what)
+		}
+	}
+	if decision.Truncate {
+		l.annotate(p.frame, "truncated", fmt.Sprintf("to %d bytes", len(p.data)))
+		if !quietMode {
+			fmt.Printf("%s %s TRUNCATED %s to %d bytes\n", tag, l.name, p.what, len(p.data))
+		}
+	}
+
+	if bottleneck != nil {
+		var mark func()
+		if p.ect {
+			mark = func() {
+				if err := protocol.MarkCE(p.data); err == nil {
+					l.annotate(p.frame, "ce-marked", "")
+					if !quietMode {
+						fmt.Printf("%s %s CE-MARKED %s\n", tag, l.name, p.what)
+					}
+				}
+			}
+		}
+		err := bottleneck.Enqueue(len(p.data), mark, func(dropped bool) {
+			l.traced(p, decision, dropped)
+			if dropped {
+				l.annotate(p.frame, "dropped", "aqm at queue head")
+				if !quietMode {
+					fmt.Printf("%s %s AQM-DROPPED %s at queue head - %s\n", tag, l.name, p.what, bottleneck.Snapshot())
+				}
+				return
+			}
+			l.transmit(conn, p, decision, quietMode)
+		})
+		if err != nil {
+			l.traced(p, decision, true)
+			l.annotate(p.frame, "dropped", err.Error())
+			if !quietMode {
+				fmt.Printf("%s %s %s %s - %s\n", tag, l.name, strings.ToUpper(err.Error()), p.what, bottleneck.Snapshot())
+			}
+		}
+		return
+	}
+
+	l.traced(p, decision, false)
+	l.transmit(conn, p, decision, quietMode)
+}
+
+// transmit puts a packet on the wire once it left the bottleneck, applying
+// duplication and delay
+func (l *link) transmit(conn *net.UDPConn, p packet, decision netem.Decision, quietMode bool) {
+	write := func(what string) {
+		_, err := conn.WriteToUDP(p.data, p.dst)
+		if err != nil {
+			if !quietMode {
+				fmt.Printf("%s %s forward %s failed: %v\n", tag, l.name, what, err)
+			}
+			return
+		}
+		if l.capture != nil {
+			frame, err := l.capture.Packet(time.Now(), conn.LocalAddr().(*net.UDPAddr), p.dst, p.data)
+			if err != nil {
+				fmt.Printf("%s %s capture failed: %v\n", tag, l.name, err)
+			}
+			l.annotate(frame, "forwarded", fmt.Sprintf("%s of frame %d", what, p.frame))
+		}
+		if !quietMode {
+			fmt.Printf("%s %s forwarded %s\n", tag, l.name, what)
+		}
+	}
+
+	// after sends right away or hands the packet to the timers, deadlines
+	// count from the same instant so a duplicate keeps its distance
+	now := time.Now()
+	after := func(delay time.Duration, what string) {
+		if delay <= 0 {
+			write(what)
+			return
+		}
+		if !l.timers.At(now.Add(delay), func() { write(what) }) {
+			l.annotate(p.frame, "dropped", "shutting down")
+			if !quietMode {
+				fmt.Printf("%s %s DROPPED %s, shutting down\n", tag, l.name, what)
+			}
+		}
+	}
+
+	if decision.Delay > 0 {
+		l.annotate(p.frame, "delayed", fmt.Sprintf("%v reordered=%v", decision.Delay.Round(time.Microsecond), decision.Reorder))
+		if !quietMode {
+			fmt.Printf("%s %s will DELAY %s by %v (reordered: %v) - %s\n",
+				tag, l.name, p.what, decision.Delay.Round(time.Microsecond), decision.Reorder, l.stats.Snapshot())
+		}
+	}
+	after(decision.Delay, p.what)
+
+	if decision.Duplicate {
+		l.annotate(p.frame, "duplicated", fmt.Sprintf("copy %v later", decision.DuplicateDelay))
+		if !quietMode {
+			fmt.Printf("%s %s DUPLICATED %s (copy %v later)\n", tag, l.name, p.what, decision.DuplicateDelay)
+		}
+		after(decision.Delay+decision.DuplicateDelay, p.what+" (duplicate)")
+	}
+}
+
+func main() {
+	// load config
+	cfg, err := config.LoadConfig("")
+	if err != nil {
+		fmt.Printf("config load failed: %v\n", err)
+		return
+	}
+
+	name := flag.String("name", "proxy1", "which proxy listed under proxies in the config to run")
+	quiet := flag.Bool("q", false, "quiet mode")
+	seed := flag.Int64("seed", 0, "seed for every impairment decision, default from the config, 0 picks one from the clock")
+	capturePath := flag.String("capture", "", "write every datagram to this pcap file, events go to a .events.csv next to it, default from the config")
+	flag.Parse()
+	quietMode := *quiet
+
+	proxyConfig := cfg.GetProxyConfig()
+	instance, err := cfg.GetProxyInstance(*name)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	tag = "[" + strings.ToUpper((*name)[:1]) + (*name)[1:] + "]"
+
+	// "ctl" talks to the control API of a running proxy instead
+	if flag.Arg(0) == "ctl" {
+		if err := runCtl(instance.Control, flag.Args()[1:]); err != nil {
+			fmt.Printf("ctl: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(instance.Clients) == 0 {
+		fmt.Printf("proxy %s lists no clients\n", *name)
+		return
+	}
+
+	// flags given on the command line win over the config
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["seed"] {
+		*seed = instance.Seed
+	}
+	if !set["capture"] {
+		*capturePath = instance.Capture
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	// create UDP listener (receive packets from Server)
+	proxyAddr := instance.ListenIP + ":" + instance.ListenPort
+	addr, err := net.ResolveUDPAddr("udp", proxyAddr)
+	if err != nil {
+		fmt.Printf("resolve UDP address failed: %v\n", err)
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		fmt.Printf("create UDP listener failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	clientAddrs := instance.Clients
+	if !quietMode {
+		fmt.Printf("UDP proxy %s started, listening on: %s\n", *name, proxyAddr)
+		fmt.Printf("target client addresses: %v\n", clientAddrs)
+	}
+
+	// resolve client addresses
+	var clientUDPAddrs []*net.UDPAddr
+	for _, clientAddr := range clientAddrs {
+		clientUDPAddr, err := net.ResolveUDPAddr("udp", clientAddr)
+		if err != nil {
+			fmt.Printf("resolve client UDP address %s failed: %v\n", clientAddr, err)
+			return
+		}
+		clientUDPAddrs = append(clientUDPAddrs, clientUDPAddr)
+	}
+	flows := newFlowTable(clientUDPAddrs, proxyConfig.FlowIdleTimeout)
+
+	// forward impairs data packets from the Server, reverse impairs every
+	// control packet from the Client (HELLO-ACK, ACK, NACK and FIN)
+	fmt.Printf("%s seed: %d (rerun with -seed %d to repeat the impairment)\n", *name, *seed, *seed)
+	timers := netem.NewTimers()
+	rules, err := netem.NewRules(instance.Rules)
+	if err != nil {
+		fmt.Printf("invalid %s rules: %v\n", *name, err)
+		return
+	}
+	forward, err := newLink("forward", "Server->Client", instance.Impairment, instance.Schedule, *seed, timers, rules)
+	if err != nil {
+		fmt.Printf("invalid %s impairment: %v\n", *name, err)
+		return
+	}
+	reverse, err := newLink("reverse", "Client->Server", instance.ReverseImpairment, instance.ReverseSchedule, *seed^reverseSeedMix, timers, rules)
+	if err != nil {
+		fmt.Printf("invalid %s reverse impairment: %v\n", *name, err)
+		return
+	}
+
+	// the capture sees both directions, frames are numbered in one sequence
+	var pcap *capture.Writer
+	if *capturePath != "" {
+		pcap, err = capture.Open(*capturePath)
+		if err != nil {
+			fmt.Printf("open capture failed: %v\n", err)
+			return
+		}
+		defer pcap.Close()
+		forward.capture = pcap
+		reverse.capture = pcap
+		fmt.Printf("%s writes %s\n", *name, pcap)
+	}
+
+	// received captures a datagram as it arrived, returns 0 without a capture
+	received := func(src *net.UDPAddr, data []byte) int {
+		if pcap == nil {
+			return 0
+		}
+		frame, err := pcap.Packet(time.Now(), src, conn.LocalAddr().(*net.UDPAddr), data)
+		if err != nil {
+			fmt.Printf("%s capture failed: %v\n", tag, err)
+		}
+		return frame
+	}
+
+	// receive and forward packets
+	buffer := make([]byte, protocol.MaxPacketSize)
+	packetCount := 0
+
+	if !quietMode {
+		fmt.Printf("%s started listening and forwarding (server->client: %s; client->server: %s)...\n", *name,
+			forward, reverse)
+		fmt.Printf("%s rules: %s\n", *name, rules)
+		for _, l := range []*link{forward, reverse} {
+			if l.recorder != nil {
+				fmt.Printf("%s records %s outcomes to %s\n", *name, l.name, l.recorder.Path())
+			}
+		}
+
+		// periodically print per-direction impairment and loss burst stats
+		go func() {
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				forward.printStats()
+				reverse.printStats()
+				pending, maxPending := timers.Pending()
+				fmt.Printf("%s delayed packets pending %d (max %d)\n", tag, pending, maxPending)
+				for _, f := range flows.snapshot() {
+					fmt.Printf("%s flow %s: %d to client, %d to server, idle %v\n",
+						tag, &f, f.toClient, f.toServer, time.Since(f.lastSeen).Round(time.Millisecond))
+				}
+			}
+		}()
+	}
+
+	if instance.Control != "" {
+		control := &controlServer{
+			seed:      *seed,
+			links:     map[string]*link{"forward": forward, "reverse": reverse},
+			flows:     flows,
+			rules:     rules,
+			quietMode: quietMode,
+		}
+		if err := control.listen(instance.Control); err != nil {
+			fmt.Printf("start control API failed: %v\n", err)
+			return
+		}
+		if !quietMode {
+			fmt.Printf("%s control API on %s (proxy -name %s ctl status)\n", *name, instance.Control, *name)
+		}
+	}
+
+	// forget flows that went quiet
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, f := range flows.expire(now) {
+				if !quietMode {
+					fmt.Printf("%s flow %s expired after %v idle\n", tag, f, flows.idleTimeout)
+				}
+			}
+		}
+	}()
+
+	// print final stats with the seed when stopped
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		// delayed packets still go out, the transfer may depend on them
+		flushed := timers.Close(true)
+		fmt.Printf("\n%s === Final Statistics (seed %d) ===\n", tag, *seed)
+		fmt.Printf("%s flushed %d delayed packets on shutdown\n", tag, flushed)
+		forward.printStats()
+		reverse.printStats()
+		if pcap != nil {
+			if err := pcap.Close(); err != nil {
+				fmt.Printf("%s close capture failed: %v\n", tag, err)
+			}
+		}
+		os.Exit(0)
+	}()
+
+	// schedules start with the first packet from the Server
+	var startSchedules sync.Once
+
+	for {
+		n, senderAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			fmt.Printf("read UDP data failed: %v\n", err)
+			continue
+		}
+
+		frame := received(senderAddr, buffer[:n])
+
+		header, err := protocol.ParseHeader(buffer[:n])
+		if err != nil {
+			if pcap != nil {
+				pcap.Annotate(frame, time.Now(), "dropped", "", "malformed: "+err.Error())
+			}
+			if !quietMode {
+				fmt.Printf("%s drop malformed packet from %s: %v\n", tag, senderAddr, err)
+			}
+			continue
+		}
+		message := header.String()
+
+		// Copy data to avoid buffer reuse issues
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		// Check if message is from Server or Client
+		if flows.isClient(senderAddr) {
+			// Message from Client (HELLO-ACK, ACK, NACK or FIN) - forward to the Server of its flow
+			if !header.Type.FromReceiver() {
+				reverse.annotate(frame, "dropped", "not sent by clients")
+				continue
+			}
+			f, err := flows.fromClient(senderAddr, header)
+			if err != nil {
+				reverse.annotate(frame, "dropped", err.Error())
+				if !quietMode {
+					fmt.Printf("%s drop %s from %s: %v\n", tag, message, senderAddr, err)
+				}
+				continue
+			}
+
+			decision, trace := reverse.decide(header, frame, true, quietMode)
+			reverse.send(conn, packet{data: data, dst: f.server, what: message, frame: frame, trace: trace}, decision, quietMode)
+			continue
+		}
+
+		// Message from Server - forward to the Client of its flow
+		f, created, err := flows.fromServer(senderAddr, header)
+		if err != nil {
+			forward.annotate(frame, "dropped", err.Error())
+			if !quietMode {
+				fmt.Printf("%s drop %s from %s: %v\n", tag, message, senderAddr, err)
+			}
+			continue
+		}
+		if created && !quietMode {
+			fmt.Printf("%s new flow %s\n", tag, f)
+		}
+
+		startSchedules.Do(func() {
+			for _, l := range []*link{forward, reverse} {
+				if l.schedule != nil {
+					go l.runSchedule(quietMode)
+				}
+			}
+		})
+
+		packetCount++
+
+		if !quietMode {
+			fmt.Printf("%s received: %s from Server %s (packet #%d)\n", *name, message, senderAddr, packetCount)
+		}
+
+		// only data packets are impaired on the way to the Client, rules
+		// match every type
+		isData := header.Type == protocol.TypeData
+		decision, trace := forward.decide(header, frame, isData, quietMode)
+		forward.send(conn, packet{data: data, dst: f.client, what: fmt.Sprintf("packet #%d", packetCount), ect: isData, frame: frame, trace: trace}, decision, quietMode)
+	}
+}
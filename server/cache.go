@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+)
+
+// retransmitCache keeps sent packets for retransmission. Sequence numbers are
+// contiguous, so everything below low has been evicted, either because all
+// receivers acknowledged it or because the cache hit its limit
+type retransmitCache struct {
+	mu          sync.RWMutex
+	packets     map[int]PacketBuffer
+	low         int // lowest sequence number still cached
+	highestSent int
+	limit       int // 0 means unlimited
+	forced      int // packets evicted by the limit before every receiver acked them
+}
+
+func newRetransmitCache(limit int) *retransmitCache {
+	return &retransmitCache{
+		packets: make(map[int]PacketBuffer),
+		low:     1,
+		limit:   limit,
+	}
+}
+
+// add caches a freshly sent packet and enforces the limit
+func (c *retransmitCache) add(packet PacketBuffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.packets[packet.seqNum] = packet
+	c.highestSent = max(c.highestSent, packet.seqNum)
+
+	for c.limit > 0 && len(c.packets) > c.limit {
+		delete(c.packets, c.low)
+		c.low++
+		c.forced++
+	}
+}
+
+// get looks up a packet, evicted reports that it was cached once but is gone
+func (c *retransmitCache) get(seqNum int) (packet PacketBuffer, exists bool, evicted bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	packet, exists = c.packets[seqNum]
+	return packet, exists, !exists && seqNum < c.low
+}
+
+// ackUpTo evicts every packet below seqNum, returns how many were removed
+func (c *retransmitCache) ackUpTo(seqNum int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for ; c.low < seqNum && c.low <= c.highestSent; c.low++ {
+		if _, ok := c.packets[c.low]; ok {
+			delete(c.packets, c.low)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *retransmitCache) highest() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.highestSent
+}
+
+func (c *retransmitCache) stats() (size int, forced int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.packets), c.forced
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// clientState is what the server knows about one receiver. It is keyed by
+// the client ID carried in every control message, so it stays the same no
+// matter which proxy or path the client's messages arrive on
+type clientState struct {
+	id          uint32
+	addr        *net.UDPAddr // path the latest message came in on, retransmissions go back there
+	registered  bool         // answered the HELLO
+	ackedUpTo   int          // cumulative ACK
+	completed   bool         // sent FIN
+	ceEchoed    uint32       // CE count from the latest ACK
+	nacks       int
+	retransmits int
+}
+
+// lookupClient returns the state for the client ID, creating it on first
+// contact, and remembers the path the message came in on.
+// Caller must hold clientsMutex
+func lookupClient(id uint32, addr *net.UDPAddr) *clientState {
+	client, ok := clients[id]
+	if !ok {
+		client = &clientState{id: id}
+		clients[id] = client
+	}
+	client.addr = addr
+	return client
+}
+
+// completedClients counts registered clients that finished, the server is
+// done when it equals the registered count
+func completedClients() (completed int, registered int) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	for _, client := range clients {
+		if !client.registered {
+			continue
+		}
+		registered++
+		if client.completed {
+			completed++
+		}
+	}
+	return completed, registered
+}
+
+func printClientStats() {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	ids := make([]uint32, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		client := clients[id]
+		fmt.Printf("client %d via %s: completed=%v, acked up to %d, NACKs %d, retransmitted %d, CE marks %d\n",
+			id, client.addr, client.completed, client.ackedUpTo, client.nacks, client.retransmits, client.ceEchoed)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	ceReactionHoldoff = 200 * time.Millisecond // marks closer than this count as one congestion event
+	minCutInterval    = 100 * time.Microsecond // first backoff step when the configured interval is 0
+	maxInterval       = 1 * time.Second
+)
+
+// pacer spaces data packets. When a client echoes new CE marks the send rate
+// is halved (the interval doubles), every ACK without new marks moves the
+// interval a quarter of the way back to the configured one
+type pacer struct {
+	mu       sync.Mutex
+	base     time.Duration
+	current  time.Duration
+	lastCut  time.Time
+	cuts     int
+	slowest  time.Duration
+	ceEvents int
+}
+
+func newPacer(base time.Duration) *pacer {
+	return &pacer{base: base, current: base, slowest: base}
+}
+
+func (p *pacer) interval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// congestion reacts to newly echoed CE marks, returns the new interval and
+// whether the rate was cut
+func (p *pacer) congestion(now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ceEvents++
+	if now.Sub(p.lastCut) < ceReactionHoldoff {
+		return p.current, false
+	}
+
+	p.lastCut = now
+	p.cuts++
+	p.current = min(max(2*p.current, minCutInterval), maxInterval)
+	p.slowest = max(p.slowest, p.current)
+	return p.current, true
+}
+
+// recover is called for ACKs that carry no new CE marks
+func (p *pacer) recover() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == p.base {
+		return
+	}
+	p.current -= (p.current - p.base) / 4
+	if p.current-p.base < p.base/100+time.Microsecond {
+		p.current = p.base
+	}
+}
+
+func (p *pacer) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return fmt.Sprintf("rate control: %d CE echoes, %d rate cuts, interval now %v (configured %v, slowest %v)",
+		p.ceEvents, p.cuts, p.current, p.base, p.slowest)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"go-network-mini-project/config"
+	"go-network-mini-project/protocol"
+)
+
+const (
+	defaultPacketCount     = 10000
+	defaultInterval        = 10 * time.Millisecond
+	defaultShutdownTimeout = 60 * time.Second
+)
+
+// runParams are the sender settings for one run, built from the sender
+// section of config.yaml and overridden by command-line flags
+type runParams struct {
+	packetCount     int
+	interval        time.Duration
+	payloadSize     int
+	duration        time.Duration // > 0 switches to duration mode, packetCount is ignored
+	shutdownTimeout time.Duration
+	quietMode       bool
+}
+
+func parseParams(senderConfig config.SenderConfig, args []string) (runParams, error) {
+	params := runParams{
+		packetCount:     defaultPacketCount,
+		interval:        defaultInterval,
+		payloadSize:     senderConfig.PayloadSize,
+		duration:        senderConfig.Duration,
+		shutdownTimeout: defaultShutdownTimeout,
+	}
+	if senderConfig.PacketCount > 0 {
+		params.packetCount = senderConfig.PacketCount
+	}
+	if senderConfig.Interval > 0 {
+		params.interval = senderConfig.Interval
+	}
+	if senderConfig.ShutdownTimeout > 0 {
+		params.shutdownTimeout = senderConfig.ShutdownTimeout
+	}
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.BoolVar(&params.quietMode, "q", false, "quiet mode")
+	flags.IntVar(&params.packetCount, "count", params.packetCount, "number of packets to send")
+	flags.DurationVar(&params.interval, "interval", params.interval, "pause between packets")
+	flags.IntVar(&params.payloadSize, "payload", params.payloadSize, "payload size in bytes")
+	flags.DurationVar(&params.duration, "duration", params.duration, "send for this long instead of -count (e.g. 30s)")
+	flags.DurationVar(&params.shutdownTimeout, "timeout", params.shutdownTimeout, "how long to wait for clients after sending")
+	if err := flags.Parse(args); err != nil {
+		return runParams{}, err
+	}
+
+	switch {
+	case params.duration <= 0 && params.packetCount <= 0:
+		return runParams{}, fmt.Errorf("packet count must be positive")
+	case params.duration <= 0 && params.packetCount > int(^uint32(0)):
+		return runParams{}, fmt.Errorf("packet count %d does not fit a 32-bit sequence number", params.packetCount)
+	case params.interval < 0:
+		return runParams{}, fmt.Errorf("interval must not be negative")
+	case params.payloadSize < 0 || params.payloadSize > protocol.MaxPayloadSize:
+		return runParams{}, fmt.Errorf("payload size must be between 0 and %d", protocol.MaxPayloadSize)
+	}
+	return params, nil
+}
+
+// totalPackets is what the HELLO announces, unknown up front in duration mode
+func (p runParams) totalPackets() uint32 {
+	if p.duration > 0 {
+		return protocol.Unbounded
+	}
+	return uint32(p.packetCount)
+}
+
+// done reports whether the send loop should stop before sending seqNum. A
+// duration run sends at least one packet, its final HELLO cannot announce 0:
+// that is protocol.Unbounded and would keep the clients waiting
+func (p runParams) done(seqNum int, start time.Time) bool {
+	if p.duration > 0 {
+		return seqNum > 1 && time.Since(start) >= p.duration
+	}
+	return seqNum > p.packetCount
+}
+
+func (p runParams) String() string {
+	mode := fmt.Sprintf("%d packets", p.packetCount)
+	if p.duration > 0 {
+		mode = fmt.Sprintf("for %v", p.duration)
+	}
+	return fmt.Sprintf("sending %s every %v, payload %d bytes, shutdown timeout %v",
+		mode, p.interval, p.payloadSize, p.shutdownTimeout)
+}
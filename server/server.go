@@ -2,31 +2,46 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go-network-mini-project/config"
+	"go-network-mini-project/protocol"
 )
 
 type PacketBuffer struct {
 	seqNum    int
-	message   string
+	packet    protocol.Packet
 	timestamp time.Time
 }
 
 var (
-	packetCache      = make(map[int]PacketBuffer) // cache for retransmission
-	cacheMutex       sync.RWMutex
-	retransmitChan   = make(chan RetransmitRequest, 100)
-	clientsCompleted = make(map[string]bool) // track which clients have finished
-	clientsMutex     sync.Mutex
+	cache          *retransmitCache // cache for retransmission
+	pace           *pacer           // send interval, slowed down by CE echoes
+	retransmitChan = make(chan RetransmitRequest, 100)
+	clients        = make(map[uint32]*clientState) // receivers by client ID, guarded by clientsMutex
+	clientsMutex   sync.Mutex
+	helloAcked     []*net.UDPAddr // sources of the HELLO-ACKs, guarded by clientsMutex
+	corruptCount   int            // control packets that failed the checksum, only touched by nackListener
+	evictedNACKs   atomic.Int64   // NACKed packets that were already evicted
 )
 
+const (
+	helloRetry        = 500 * time.Millisecond
+	handshakeTimeout  = 10 * time.Second
+	defaultCacheLimit = 4096
+)
+
+// RetransmitRequest carries the ranges of one selective NACK, they are
+// expanded into single retransmissions by retransmitHandler
 type RetransmitRequest struct {
-	seqNum     int
+	ranges     []protocol.SeqRange
+	clientID   uint32
 	clientAddr *net.UDPAddr
 	conn       *net.UDPConn
 }
@@ -39,8 +54,25 @@ func main() {
 		return
 	}
 
-	proxyConfig := cfg.GetProxyConfig()
-	quietMode := len(os.Args) > 1 && os.Args[1] == "-q"
+	serverConfig := cfg.GetServerConfig()
+	if _, err := cfg.GetClientConfig().ClientIDs(); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	params, err := parseParams(cfg.GetSenderConfig(), os.Args[1:])
+	if err != nil {
+		fmt.Printf("invalid run parameters: %v\n", err)
+		return
+	}
+	quietMode := params.quietMode
+
+	cacheLimit := serverConfig.RetransmitCacheLimit
+	if cacheLimit <= 0 {
+		cacheLimit = defaultCacheLimit
+	}
+	cache = newRetransmitCache(cacheLimit)
+	pace = newPacer(params.interval)
 
 	// create UDP listener (not dial, so we can use WriteToUDP)
 	serverAddr := "0.0.0.0:0" // bind to any available port
@@ -58,22 +90,42 @@ func main() {
 	defer conn.Close()
 
 	// resolve Proxy addresses
-	proxy1Addr := proxyConfig.UDPProxy1IP + ":" + proxyConfig.UDPProxy1ListenPort
+	proxy1, err := cfg.GetProxyInstance("proxy1")
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	proxy1Addr := proxy1.ListenIP + ":" + proxy1.ListenPort
 	proxy1UDPAddr, err := net.ResolveUDPAddr("udp", proxy1Addr)
 	if err != nil {
 		fmt.Printf("resolve Proxy 1 UDP address failed: %v\n", err)
 		return
 	}
+	if proxy1UDPAddr.IP == nil || proxy1UDPAddr.IP.IsUnspecified() {
+		fmt.Printf("Proxy 1 listen_ip %q is not an address the server can send to\n", proxy1.ListenIP)
+		return
+	}
 
-	proxy2Addr := proxyConfig.UDPProxy2IP + ":" + proxyConfig.UDPProxy2ListenPort
+	proxy2, err := cfg.GetProxyInstance("proxy2")
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	proxy2Addr := proxy2.ListenIP + ":" + proxy2.ListenPort
 	proxy2UDPAddr, err := net.ResolveUDPAddr("udp", proxy2Addr)
 	if err != nil {
 		fmt.Printf("resolve Proxy 2 UDP address failed: %v\n", err)
 		return
 	}
+	if proxy2UDPAddr.IP == nil || proxy2UDPAddr.IP.IsUnspecified() {
+		fmt.Printf("Proxy 2 listen_ip %q is not an address the server can send to\n", proxy2.ListenIP)
+		return
+	}
+
+	sessionID := rand.Uint32()
 
 	// start NACK listener
-	go nackListener(conn, quietMode)
+	go nackListener(conn, sessionID, quietMode)
 
 	// start retransmit handler
 	go retransmitHandler(quietMode)
@@ -81,25 +133,52 @@ func main() {
 	if !quietMode {
 		fmt.Printf("UDP Server started on %s, sending to Proxy 1: %s and Proxy 2: %s\n",
 			conn.LocalAddr().String(), proxy1Addr, proxy2Addr)
+		fmt.Printf("session ID: %08x\n", sessionID)
+		fmt.Println(params)
 	}
 
-	// send 10000 packets
-	for i := 1; i <= 10000; i++ {
-		// add timestamp (RFC3339Nano format) to packet content
-		timestamp := time.Now().Format(time.RFC3339Nano)
-		message := fmt.Sprintf("SEQ:%d|%s", i, timestamp)
+	// announce stream parameters and wait until both clients confirm
+	paths := []*net.UDPAddr{proxy1UDPAddr, proxy2UDPAddr}
+	hello := protocol.NewHello(sessionID, protocol.Hello{
+		PayloadSize:  uint16(params.payloadSize),
+		TotalPackets: params.totalPackets(),
+	})
+	if err := handshake(conn, hello, paths, quietMode); err != nil {
+		fmt.Printf("handshake failed: %v\n", err)
+		return
+	}
+
+	// every data packet carries the same filler payload
+	payload := make([]byte, params.payloadSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// send packets until the count or duration is reached
+	start := time.Now()
+	sent := 0
+	for i := 1; !params.done(i, start); i++ {
+		// send timestamp travels in the packet header
+		packet := protocol.Packet{
+			Header: protocol.Header{
+				Type:      protocol.TypeData,
+				SessionID: sessionID,
+				Seq:       uint32(i),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Payload: payload,
+		}
+		message := packet.Marshal()
 
 		// cache packet for potential retransmission
-		cacheMutex.Lock()
-		packetCache[i] = PacketBuffer{
+		cache.add(PacketBuffer{
 			seqNum:    i,
-			message:   message,
+			packet:    packet,
 			timestamp: time.Now(),
-		}
-		cacheMutex.Unlock()
+		})
 
 		// send to Proxy 1
-		_, err := conn.WriteToUDP([]byte(message), proxy1UDPAddr)
+		_, err := conn.WriteToUDP(message, proxy1UDPAddr)
 		if err != nil {
 			if !quietMode {
 				fmt.Printf("send Packet %d to Proxy 1 failed: %v\n", i, err)
@@ -109,7 +188,7 @@ func main() {
 		}
 
 		// send to Proxy 2
-		_, err = conn.WriteToUDP([]byte(message), proxy2UDPAddr)
+		_, err = conn.WriteToUDP(message, proxy2UDPAddr)
 		if err != nil {
 			if !quietMode {
 				fmt.Printf("send Packet %d to Proxy 2 failed: %v\n", i, err)
@@ -118,16 +197,27 @@ func main() {
 			fmt.Printf("sent: Packet %d to Proxy 2\n", i)
 		}
 
-		// wait 10ms (adjust for 10000 packets)
-		time.Sleep(10 * time.Millisecond)
+		sent = i
+		time.Sleep(pace.interval())
 	}
 
 	if !quietMode {
-		fmt.Println("all packets sent, waiting for retransmit requests...")
+		fmt.Printf("all %d packets sent, waiting for retransmit requests...\n", sent)
 	}
 
-	// wait for both clients to finish or timeout after 60 seconds
-	timeout := time.After(60 * time.Second)
+	// in duration mode the clients learn the final count from a second HELLO,
+	// it is repeated until they finish in case it gets lost
+	var finalHello []byte
+	if params.totalPackets() == protocol.Unbounded {
+		finalHello = protocol.NewHello(sessionID, protocol.Hello{
+			PayloadSize:  uint16(params.payloadSize),
+			TotalPackets: uint32(sent),
+		}).Marshal()
+		sendToPaths(conn, finalHello, paths, quietMode)
+	}
+
+	// wait for every registered client to finish or timeout
+	timeout := time.After(params.shutdownTimeout)
 	checkTicker := time.NewTicker(2 * time.Second)
 	defer checkTicker.Stop()
 
@@ -136,20 +226,27 @@ func main() {
 		case <-timeout:
 			if !quietMode {
 				fmt.Println("timeout reached, shutting down server")
+				printClientStats()
+				printCacheStats()
+				fmt.Println(pace)
 			}
 			return
 		case <-checkTicker.C:
-			clientsMutex.Lock()
-			completedCount := len(clientsCompleted)
-			clientsMutex.Unlock()
+			completedCount, registeredCount := completedClients()
+			if finalHello != nil && completedCount < registeredCount {
+				sendToPaths(conn, finalHello, paths, quietMode)
+			}
 
 			if !quietMode {
-				fmt.Printf("clients completed: %d/2\n", completedCount)
+				fmt.Printf("clients completed: %d/%d\n", completedCount, registeredCount)
 			}
 
-			if completedCount >= 2 {
+			if completedCount >= registeredCount {
 				if !quietMode {
 					fmt.Println("all clients completed, shutting down server")
+					printClientStats()
+					printCacheStats()
+					fmt.Println(pace)
 				}
 				time.Sleep(1 * time.Second) // give time for final messages
 				return
@@ -158,8 +255,63 @@ func main() {
 	}
 }
 
-func nackListener(conn *net.UDPConn, quietMode bool) {
-	buffer := make([]byte, 1024)
+func sendToPaths(conn *net.UDPConn, message []byte, paths []*net.UDPAddr, quietMode bool) {
+	for _, path := range paths {
+		if _, err := conn.WriteToUDP(message, path); err != nil && !quietMode {
+			fmt.Printf("send to %s failed: %v\n", path, err)
+		}
+	}
+}
+
+// handshake sends HELLO on every path until the client behind it answers
+// with HELLO-ACK, lost HELLOs and acks are covered by the retry
+func handshake(conn *net.UDPConn, hello *protocol.Packet, paths []*net.UDPAddr, quietMode bool) error {
+	message := hello.Marshal()
+	deadline := time.Now().Add(handshakeTimeout)
+
+	for {
+		pending := 0
+		for _, path := range paths {
+			clientsMutex.Lock()
+			acked := helloAckedVia(path)
+			clientsMutex.Unlock()
+			if acked {
+				continue
+			}
+
+			pending++
+			if _, err := conn.WriteToUDP(message, path); err != nil && !quietMode {
+				fmt.Printf("send HELLO to %s failed: %v\n", path, err)
+			}
+		}
+
+		if pending == 0 {
+			if !quietMode {
+				fmt.Println("handshake completed on all paths")
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d path(s) did not answer HELLO within %v", pending, handshakeTimeout)
+		}
+		time.Sleep(helloRetry)
+	}
+}
+
+// helloAckedVia reports whether a HELLO-ACK came from path. Addresses are
+// compared by IP and port, the strings differ e.g. for IPv4-mapped IPv6.
+// Caller holds clientsMutex
+func helloAckedVia(path *net.UDPAddr) bool {
+	for _, addr := range helloAcked {
+		if addr.IP.Equal(path.IP) && addr.Port == path.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func nackListener(conn *net.UDPConn, sessionID uint32, quietMode bool) {
+	buffer := make([]byte, protocol.MaxPacketSize)
 	for {
 		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 		n, addr, err := conn.ReadFromUDP(buffer)
@@ -172,65 +324,185 @@ func nackListener(conn *net.UDPConn, quietMode bool) {
 			return
 		}
 
-		message := string(buffer[:n])
+		packet, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			// corrupt NACK/FIN is dropped just like a lost one
+			corruptCount++
+			if !quietMode {
+				fmt.Printf("drop corrupt packet from %s: %v (total corrupt: %d)\n", addr, err, corruptCount)
+			}
+			continue
+		}
+
+		if packet.SessionID != sessionID {
+			if !quietMode {
+				fmt.Printf("ignore %s from %s: unknown session\n", packet.Header, addr)
+			}
+			continue
+		}
+
+		switch packet.Type {
+		case protocol.TypeHelloAck:
+			clientsMutex.Lock()
+			if !helloAckedVia(addr) {
+				helloAcked = append(helloAcked, addr)
+			}
+			client := lookupClient(packet.ClientID, addr)
+			if !client.registered {
+				client.registered = true
+				if !quietMode {
+					fmt.Printf("received HELLO-ACK from client %d via %s\n", packet.ClientID, addr)
+				}
+			}
+			clientsMutex.Unlock()
 
-		// Check for FIN message: "FIN"
-		if strings.TrimSpace(message) == "FIN" {
+		case protocol.TypeFIN:
 			clientsMutex.Lock()
-			clientKey := addr.String()
-			if !clientsCompleted[clientKey] {
-				clientsCompleted[clientKey] = true
+			client := lookupClient(packet.ClientID, addr)
+			if !client.completed {
+				client.completed = true
 				if !quietMode {
-					fmt.Printf("received FIN from %s\n", addr)
+					fmt.Printf("received FIN from client %d via %s\n", packet.ClientID, addr)
 				}
 			}
 			clientsMutex.Unlock()
-			continue
-		}
+			evictAcked(quietMode)
 
-		// NACK format: "NACK:123"
-		if strings.HasPrefix(message, "NACK:") {
-			var seqNum int
-			_, err := fmt.Sscanf(message, "NACK:%d", &seqNum)
+			// confirm every FIN, a lost FIN-ACK makes the client resend its FIN
+			finAck := protocol.NewFinAck(sessionID, packet.ClientID).Marshal()
+			if _, err := conn.WriteToUDP(finAck, addr); err != nil && !quietMode {
+				fmt.Printf("send FIN-ACK to client %d via %s failed: %v\n", packet.ClientID, addr, err)
+			}
+
+		case protocol.TypeAck:
+			ceCount, err := protocol.ParseAckCE(packet)
 			if err != nil {
 				if !quietMode {
-					fmt.Printf("parse NACK failed: %v\n", err)
+					fmt.Printf("parse ACK from %s failed: %v\n", addr, err)
 				}
 				continue
 			}
 
+			clientsMutex.Lock()
+			client := lookupClient(packet.ClientID, addr)
+			client.ackedUpTo = max(client.ackedUpTo, int(packet.Seq))
+			// a reordered older ACK has a smaller count and is no new signal
+			newMarks := int64(ceCount) - int64(client.ceEchoed)
+			client.ceEchoed = max(client.ceEchoed, ceCount)
+			clientsMutex.Unlock()
+			evictAcked(quietMode)
+
+			if newMarks > 0 {
+				interval, cut := pace.congestion(time.Now())
+				if cut && !quietMode {
+					fmt.Printf("client %d echoed %d new CE marks, send interval now %v\n", packet.ClientID, newMarks, interval)
+				}
+			} else {
+				pace.recover()
+			}
+
+		case protocol.TypeNACK:
+			ranges, err := protocol.ParseNACK(packet)
+			if err != nil {
+				if !quietMode {
+					fmt.Printf("parse NACK from %s failed: %v\n", addr, err)
+				}
+				continue
+			}
+
+			clientsMutex.Lock()
+			lookupClient(packet.ClientID, addr).nacks++
+			clientsMutex.Unlock()
+
 			if !quietMode {
-				fmt.Printf("received NACK for packet %d from %s\n", seqNum, addr)
+				fmt.Printf("received NACK for packets %v from client %d via %s\n", ranges, packet.ClientID, addr)
 			}
 
 			retransmitChan <- RetransmitRequest{
-				seqNum:     seqNum,
+				ranges:     ranges,
+				clientID:   packet.ClientID,
 				clientAddr: addr,
 				conn:       conn,
 			}
+
+		default:
+			if !quietMode {
+				fmt.Printf("unexpected %s packet from %s\n", packet.Type, addr)
+			}
 		}
 	}
 }
 
 func retransmitHandler(quietMode bool) {
 	for req := range retransmitChan {
-		cacheMutex.RLock()
-		packet, exists := packetCache[req.seqNum]
-		cacheMutex.RUnlock()
+		for _, r := range req.ranges {
+			// never expand past what was actually sent
+			last := min(int(r.Last), cache.highest())
 
-		if exists {
-			_, err := req.conn.WriteToUDP([]byte(packet.message), req.clientAddr)
-			if err != nil {
-				if !quietMode {
-					fmt.Printf("retransmit packet %d failed: %v\n", req.seqNum, err)
-				}
-			} else if !quietMode {
-				fmt.Printf("retransmitted packet %d to %s\n", req.seqNum, req.clientAddr)
+			for seqNum := int(r.First); seqNum <= last; seqNum++ {
+				retransmit(req, seqNum, quietMode)
 			}
-		} else {
+		}
+	}
+}
+
+func retransmit(req RetransmitRequest, seqNum int, quietMode bool) {
+	packet, exists, evicted := cache.get(seqNum)
+
+	if exists {
+		retransmit := packet.packet
+		retransmit.Flags |= protocol.FlagRetransmit
+		retransmit.ClientID = req.clientID
+		_, err := req.conn.WriteToUDP(retransmit.Marshal(), req.clientAddr)
+		if err != nil {
 			if !quietMode {
-				fmt.Printf("packet %d not found in cache for retransmission\n", req.seqNum)
+				fmt.Printf("retransmit packet %d failed: %v\n", seqNum, err)
 			}
+			return
+		}
+
+		clientsMutex.Lock()
+		clients[req.clientID].retransmits++
+		clientsMutex.Unlock()
+		if !quietMode {
+			fmt.Printf("retransmitted packet %d to client %d via %s\n", seqNum, req.clientID, req.clientAddr)
+		}
+	} else if evicted {
+		total := evictedNACKs.Add(1)
+		if !quietMode {
+			fmt.Printf("packet %d already evicted from cache, cannot retransmit (total: %d)\n", seqNum, total)
+		}
+	} else {
+		if !quietMode {
+			fmt.Printf("packet %d not found in cache for retransmission\n", seqNum)
+		}
+	}
+}
+
+// evictAcked drops cached packets every registered receiver has acknowledged.
+// A receiver is registered once it answered the HELLO
+func evictAcked(quietMode bool) {
+	clientsMutex.Lock()
+	lowest := math.MaxInt
+	for _, client := range clients {
+		// a finished client needs nothing more
+		if client.registered && !client.completed {
+			lowest = min(lowest, client.ackedUpTo)
 		}
 	}
+	clientsMutex.Unlock()
+
+	if lowest == math.MaxInt || lowest <= 1 {
+		return
+	}
+
+	if removed := cache.ackUpTo(lowest); removed > 0 && !quietMode {
+		fmt.Printf("evicted %d acknowledged packets below %d from cache\n", removed, lowest)
+	}
+}
+
+func printCacheStats() {
+	size, forced := cache.stats()
+	fmt.Printf("retransmit cache: %d packets left, %d evicted by limit before being acked, %d NACKs for evicted packets\n",
+		size, forced, evictedNACKs.Load())
 }
@@ -2,38 +2,44 @@
 
 function show_usage() {
     echo "usage:"
-    echo "  ./test.sh server     - Start UDP Server"
+    echo "  ./test.sh server     - Start UDP Server (extra args are passed on, e.g. -count 500 -interval 5ms)"
     echo "  ./test.sh client1    - Start UDP Client 1"
     echo "  ./test.sh client2    - Start UDP Client 2"
-    echo "  ./test.sh proxy1     - Start UDP Proxy 1"
+    echo "  ./test.sh proxy1     - Start UDP Proxy 1 (extra args are passed on, e.g. -seed 42)"
     echo "  ./test.sh proxy2     - Start UDP Proxy 2"
+    echo "  ./test.sh proxy <name> - Start the proxy of that name from the proxies section of config.yaml"
     echo "  ./test.sh all        - Start all components"
     echo "  ./test.sh all -q     - Start all components (quiet mode, only show Client results)"
 }
 
 function run_server() {
     echo "Start UDP Server..."
-    go run server/server.go
+    go run ./server "$@"
 }
 
 function run_client1() {
     echo "Start UDP Client 1..."
-    go run client1/client1.go
+    go run ./client1
 }
 
 function run_client2() {
     echo "Start UDP Client 2..."
-    go run client2/client2.go
+    go run ./client2
 }
 
 function run_proxy1() {
     echo "Start UDP Proxy 1..."
-    go run proxy1/proxy1.go
+    go run ./proxy -name proxy1 "$@"
 }
 
 function run_proxy2() {
     echo "Start UDP Proxy 2..."
-    go run proxy2/proxy2.go
+    go run ./proxy -name proxy2 "$@"
+}
+
+function run_proxy() {
+    echo "Start UDP proxy $1..."
+    go run ./proxy -name "$1" "${@:2}"
 }
 
 function run_all() {
@@ -48,9 +54,9 @@ function run_all() {
         echo "Start UDP Client 1..."
     fi
     if [ "$quiet_mode" = "-q" ]; then
-        go run client1/client1.go &
+        go run ./client1 &
     else
-        go run client1/client1.go &
+        go run ./client1 &
     fi
     
     # Start Client 2
@@ -58,9 +64,9 @@ function run_all() {
         echo "Start UDP Client 2..."
     fi
     if [ "$quiet_mode" = "-q" ]; then
-        go run client2/client2.go &
+        go run ./client2 &
     else
-        go run client2/client2.go &
+        go run ./client2 &
     fi
     
     # Wait a moment to let Clients start
@@ -71,9 +77,9 @@ function run_all() {
         echo "Start UDP Proxy 1..."
     fi
     if [ "$quiet_mode" = "-q" ]; then
-        go run proxy1/proxy1.go -q > /dev/null 2>&1 &
+        go run ./proxy -name proxy1 -q > /dev/null 2>&1 &
     else
-        go run proxy1/proxy1.go &
+        go run ./proxy -name proxy1 &
     fi
     
     # Start Proxy 2
@@ -81,9 +87,9 @@ function run_all() {
         echo "Start UDP Proxy 2..."
     fi
     if [ "$quiet_mode" = "-q" ]; then
-        go run proxy2/proxy2.go -q > /dev/null 2>&1 &
+        go run ./proxy -name proxy2 -q > /dev/null 2>&1 &
     else
-        go run proxy2/proxy2.go &
+        go run ./proxy -name proxy2 &
     fi
     
     # Wait a moment to let Proxies start
@@ -94,9 +100,9 @@ function run_all() {
         echo "Start UDP Server..."
     fi
     if [ "$quiet_mode" = "-q" ]; then
-        go run server/server.go -q > /dev/null 2>&1
+        go run ./server -q > /dev/null 2>&1
     else
-        go run server/server.go
+        go run ./server
     fi
 }
 
@@ -111,7 +117,7 @@ quiet_flag=${2:-""}
 
 case $command in
     server)
-        run_server
+        run_server "${@:2}"
         ;;
     client1)
         run_client1
@@ -120,10 +126,13 @@ case $command in
         run_client2
         ;;
     proxy1)
-        run_proxy1
+        run_proxy1 "${@:2}"
         ;;
     proxy2)
-        run_proxy2
+        run_proxy2 "${@:2}"
+        ;;
+    proxy)
+        run_proxy "${@:2}"
         ;;
     all)
         run_all "$quiet_flag"